@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"net"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// AddrFilter decides which peer addresses supplied in relay handshakes the
+// relay is willing to use.
+//
+// An address is accepted if its IP (if any) is in one of the Allow ranges.
+// Otherwise, it is rejected if its IP is in one of the Deny ranges, or if it
+// is a private, loopback, link-local or unroutable address and AllowPrivate
+// is not set. Addresses without an IP component (e.g. /dns4 or /dnsaddr) may
+// resolve to any of those, and are rejected unless AllowPrivate is set.
+type AddrFilter struct {
+	// AllowPrivate permits private, loopback, link-local and unroutable IPs,
+	// and addresses without an IP.
+	AllowPrivate bool
+	// Allow lists ranges that are always accepted.
+	Allow []*net.IPNet
+	// Deny lists ranges that are always rejected, unless also in Allow.
+	Deny []*net.IPNet
+	// Protocols, when non-empty, restricts accepted addresses to those
+	// composed only of the listed protocol codes.
+	Protocols []int
+}
+
+// NewAddrFilter returns the default filter, which rejects private, loopback,
+// link-local and unroutable addresses, and addresses without an IP.
+func NewAddrFilter() *AddrFilter {
+	return &AddrFilter{}
+}
+
+// Allowed returns true if the filter accepts the address. A nil filter
+// accepts nothing.
+func (f *AddrFilter) Allowed(a ma.Multiaddr) bool {
+	if f == nil {
+		return false
+	}
+
+	if len(f.Protocols) > 0 {
+		for _, p := range a.Protocols() {
+			if !containsProto(f.Protocols, p.Code) {
+				return false
+			}
+		}
+	}
+
+	ip, err := manet.ToIP(a)
+	if err != nil {
+		// no IP component: names could resolve to private addresses
+		return f.AllowPrivate
+	}
+
+	if inRange(ip, f.Allow) {
+		return true
+	}
+
+	if inRange(ip, f.Deny) {
+		return false
+	}
+
+	if f.AllowPrivate {
+		return true
+	}
+
+	return !(ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		inRange(ip, manet.Private4) || inRange(ip, manet.Private6) ||
+		inRange(ip, manet.Unroutable4) || inRange(ip, manet.Unroutable6))
+}
+
+// Filter returns the addresses accepted by the filter.
+func (f *AddrFilter) Filter(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if f == nil {
+		return nil
+	}
+
+	result := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if f.Allowed(a) {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func inRange(ip net.IP, ipnets []*net.IPNet) bool {
+	for _, ipnet := range ipnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsProto(protos []int, code int) bool {
+	for _, p := range protos {
+		if p == code {
+			return true
+		}
+	}
+	return false
+}
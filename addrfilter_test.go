@@ -0,0 +1,55 @@
+package relay_test
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipnet
+}
+
+func TestAddrFilter(t *testing.T) {
+	deny := &AddrFilter{Deny: []*net.IPNet{mustParseCIDR(t, "1.2.3.0/24")}}
+	allow := &AddrFilter{Allow: []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")}}
+	protos := &AddrFilter{Protocols: []int{ma.P_IP4, ma.P_TCP}}
+
+	for _, tc := range []struct {
+		filter  *AddrFilter
+		addr    string
+		allowed bool
+	}{
+		{NewAddrFilter(), "/ip4/1.2.3.4/tcp/4001", true},
+		{NewAddrFilter(), "/ip4/127.0.0.1/tcp/4001", false},
+		{NewAddrFilter(), "/ip4/192.168.1.1/tcp/4001", false},
+		{NewAddrFilter(), "/ip4/169.254.1.1/tcp/4001", false},
+		{NewAddrFilter(), "/ip4/0.0.0.0/tcp/4001", false},
+		{NewAddrFilter(), "/ip6/::1/tcp/4001", false},
+		{NewAddrFilter(), "/ip6/fe80::1/tcp/4001", false},
+		{NewAddrFilter(), "/dns4/example.com/tcp/4001", false},
+		{NewAddrFilter(), "/dns4/localhost/tcp/4001", false},
+		{NewAddrFilter(), "/dns6/localhost/tcp/4001", false},
+		{NewAddrFilter(), "/dnsaddr/example.com", false},
+		{&AddrFilter{AllowPrivate: true}, "/ip4/127.0.0.1/tcp/4001", true},
+		{&AddrFilter{AllowPrivate: true}, "/dns4/example.com/tcp/4001", true},
+		{deny, "/ip4/1.2.3.4/tcp/4001", false},
+		{deny, "/ip4/1.2.4.4/tcp/4001", true},
+		{allow, "/ip4/10.1.2.3/tcp/4001", true},
+		{allow, "/ip4/10.2.2.3/tcp/4001", false},
+		{protos, "/ip4/1.2.3.4/tcp/4001", true},
+		{protos, "/ip4/1.2.3.4/udp/4001/quic", false},
+		{protos, "/dns4/example.com/tcp/4001", false},
+	} {
+		if allowed := tc.filter.Allowed(ma.StringCast(tc.addr)); allowed != tc.allowed {
+			t.Errorf("%s: expected allowed=%t, got %t", tc.addr, tc.allowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	// HopDialBackoffBase is the initial period during which an active relay
+	// refuses to redial a destination after a failed dial.
+	HopDialBackoffBase = 5 * time.Second
+	// HopDialBackoffMax caps the exponential growth of the dial backoff.
+	HopDialBackoffMax = 5 * time.Minute
+)
+
+var errDialBackoff = errors.New("dial backoff")
+
+type backoffEntry struct {
+	tries int
+	until time.Time
+}
+
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
+
+// dialBackoff remembers failed destination dials on an active relay and
+// coalesces concurrent dials to the same destination, so that clients can't
+// make the relay repeatedly dial unreachable peers.
+type dialBackoff struct {
+	mx      sync.Mutex
+	entries map[peer.ID]*backoffEntry
+	pending map[peer.ID]*pendingDial
+}
+
+func newDialBackoff() *dialBackoff {
+	return &dialBackoff{
+		entries: make(map[peer.ID]*backoffEntry),
+		pending: make(map[peer.ID]*pendingDial),
+	}
+}
+
+// dial runs dialf for p, unless p is backed off or another dial to p is
+// already in progress, in which case it waits for and shares that result.
+func (b *dialBackoff) dial(ctx context.Context, p peer.ID, dialf func(context.Context) error) error {
+	b.mx.Lock()
+	if e, ok := b.entries[p]; ok && time.Now().Before(e.until) {
+		b.mx.Unlock()
+		return errDialBackoff
+	}
+
+	if pd, ok := b.pending[p]; ok {
+		b.mx.Unlock()
+		select {
+		case <-pd.done:
+			return pd.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	pd := &pendingDial{done: make(chan struct{})}
+	b.pending[p] = pd
+	b.mx.Unlock()
+
+	pd.err = dialf(ctx)
+
+	b.mx.Lock()
+	delete(b.pending, p)
+	if pd.err != nil {
+		b.addBackoff(p)
+	} else {
+		delete(b.entries, p)
+	}
+	b.mx.Unlock()
+
+	close(pd.done)
+	return pd.err
+}
+
+// addBackoff must be called with the lock held.
+func (b *dialBackoff) addBackoff(p peer.ID) {
+	e, ok := b.entries[p]
+	if !ok {
+		e = new(backoffEntry)
+		b.entries[p] = e
+	}
+
+	d := HopDialBackoffBase << uint(e.tries)
+	if d > HopDialBackoffMax || d <= 0 {
+		d = HopDialBackoffMax
+	} else {
+		e.tries++
+	}
+	e.until = time.Now().Add(d)
+}
+
+// gc drops entries that expired more than HopDialBackoffMax ago; peers that
+// fail again after that start over from the base backoff.
+func (b *dialBackoff) gc() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	now := time.Now()
+	for p, e := range b.entries {
+		if now.Sub(e.until) > HopDialBackoffMax {
+			delete(b.entries, p)
+		}
+	}
+}
+
+func (b *dialBackoff) background(ctx context.Context) {
+	ticker := time.NewTicker(HopDialBackoffMax)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.gc()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestDialBackoff(t *testing.T) {
+	base, max := HopDialBackoffBase, HopDialBackoffMax
+	HopDialBackoffBase = 50 * time.Millisecond
+	HopDialBackoffMax = 200 * time.Millisecond
+	defer func() { HopDialBackoffBase, HopDialBackoffMax = base, max }()
+
+	b := newDialBackoff()
+	p := peer.ID("QmPeer")
+
+	dialErr := errors.New("dial failed")
+	var dials int32
+	fail := func(context.Context) error {
+		atomic.AddInt32(&dials, 1)
+		return dialErr
+	}
+
+	if err := b.dial(context.Background(), p, fail); err != dialErr {
+		t.Fatalf("expected dial error, got %v", err)
+	}
+
+	if err := b.dial(context.Background(), p, fail); err != errDialBackoff {
+		t.Fatalf("expected backoff error, got %v", err)
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("expected 1 dial, got %d", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := b.dial(context.Background(), p, fail); err != dialErr {
+		t.Fatalf("expected dial error, got %v", err)
+	}
+
+	// the backoff doubled, so we should still be backed off
+	time.Sleep(60 * time.Millisecond)
+
+	if err := b.dial(context.Background(), p, fail); err != errDialBackoff {
+		t.Fatalf("expected backoff error, got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := b.dial(context.Background(), p, func(context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	b.mx.Lock()
+	_, ok := b.entries[p]
+	b.mx.Unlock()
+	if ok {
+		t.Fatal("expected successful dial to clear the backoff")
+	}
+}
+
+func TestDialBackoffCoalesce(t *testing.T) {
+	b := newDialBackoff()
+	p := peer.ID("QmPeer")
+
+	var dials int32
+	release := make(chan struct{})
+	dialf := func(context.Context) error {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- b.dial(context.Background(), p, dialf)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("expected 1 dial, got %d", n)
+	}
+}
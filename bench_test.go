@@ -0,0 +1,272 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// benchTopology sets up src -[relay]-> dst on an in-memory network, with a
+// listener on dst that passes accepted connections to the returned channel.
+func benchTopology(b *testing.B) (*Relay, peer.AddrInfo, peer.AddrInfo, <-chan manet.Conn) {
+	n := relaytest.New(b, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+
+	conns := make(chan manet.Conn, 1024)
+	go func() {
+		for {
+			c, err := n.Nodes[2].Relay.Listener().Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	rinfo := n.Nodes[1].Info()
+	dinfo := peer.AddrInfo{ID: n.Nodes[2].Host.ID()}
+
+	return n.Nodes[0].Relay, rinfo, dinfo, conns
+}
+
+// closeOnEOF closes the accepted connections once the dialer closes them;
+// closing them right away would reset them before the dialer gets the status
+// of the handshake.
+func closeOnEOF(conns <-chan manet.Conn) {
+	for c := range conns {
+		go func(c manet.Conn) {
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		}(c)
+	}
+}
+
+func BenchmarkDialPeer(b *testing.B) {
+	r, rinfo, dinfo, conns := benchTopology(b)
+	go closeOnEOF(conns)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c, err := r.DialPeer(context.Background(), rinfo, dinfo)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c.Close()
+	}
+}
+
+func BenchmarkHopStreamSetupParallel(b *testing.B) {
+	r, rinfo, dinfo, conns := benchTopology(b)
+	go closeOnEOF(conns)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := r.DialPeer(context.Background(), rinfo, dinfo)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			c.Close()
+		}
+	})
+}
+
+// BenchmarkHopThroughput compares the adaptive copy engine of hop relays with
+// io.CopyBuffer, for fixed buffer sizes.
+func BenchmarkHopThroughput(b *testing.B) {
+	for _, engine := range []string{"adaptive", "io.CopyBuffer"} {
+		for _, size := range []int{1024, 4096, 16 * 1024, 64 * 1024} {
+			name := fmt.Sprintf("engine=%s/HopStreamBufferSize=%d", engine, size)
+			b.Run(name, func(b *testing.B) {
+				if engine == "io.CopyBuffer" {
+					defer UseCopyBuffer()()
+				}
+				benchmarkHopThroughput(b, size)
+			})
+		}
+	}
+}
+
+func benchmarkHopThroughput(b *testing.B, size int) {
+	bufSize, minSize, maxSize := HopStreamBufferSize, HopStreamMinBufferSize, HopStreamMaxBufferSize
+	HopStreamBufferSize, HopStreamMinBufferSize, HopStreamMaxBufferSize = size, size, size
+	defer func() {
+		HopStreamBufferSize, HopStreamMinBufferSize, HopStreamMaxBufferSize = bufSize, minSize, maxSize
+	}()
+
+	r, rinfo, dinfo, conns := benchTopology(b)
+
+	c, err := r.DialPeer(context.Background(), rinfo, dinfo)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	remote := <-conns
+	defer remote.Close()
+
+	done := make(chan error, 1)
+	chunk := make([]byte, 64*1024)
+	go func() {
+		buf := make([]byte, len(chunk))
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadFull(remote, buf); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkIdleCircuits(b *testing.B) {
+	r, rinfo, dinfo, conns := benchTopology(b)
+
+	var local, remote []io.Closer
+	defer func() {
+		for _, c := range append(local, remote...) {
+			c.Close()
+		}
+	}()
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c, err := r.DialPeer(context.Background(), rinfo, dinfo)
+		if err != nil {
+			b.Fatal(err)
+		}
+		local = append(local, c)
+		remote = append(remote, <-conns)
+	}
+
+	b.StopTimer()
+
+	// let the relay's copy goroutines settle
+	time.Sleep(100 * time.Millisecond)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/float64(b.N), "heap-B/circuit")
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/float64(b.N), "goroutines/circuit")
+}
+
+// benchCircuits is the number of circuits BenchmarkRelayedCircuits relays at
+// once.
+const benchCircuits = 10000
+
+// BenchmarkRelayedCircuits relays a message over each of benchCircuits open
+// circuits per iteration, and reports the goroutines and heap per circuit of
+// the three nodes, for the adaptive copy engine and io.CopyBuffer.
+func BenchmarkRelayedCircuits(b *testing.B) {
+	b.Run("engine=adaptive", benchmarkRelayedCircuits)
+	b.Run("engine=io.CopyBuffer", func(b *testing.B) {
+		defer UseCopyBuffer()()
+		benchmarkRelayedCircuits(b)
+	})
+}
+
+func benchmarkRelayedCircuits(b *testing.B) {
+	r, rinfo, dinfo, conns := benchTopology(b)
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	local := make([]io.ReadWriteCloser, benchCircuits)
+	remote := make([]io.ReadWriteCloser, benchCircuits)
+	defer func() {
+		for _, c := range append(local, remote...) {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, benchCircuits)
+	for w := 0; w < 64; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < benchCircuits; i += 64 {
+				c, err := r.DialPeer(context.Background(), rinfo, dinfo)
+				if err != nil {
+					errs <- err
+					return
+				}
+				local[i] = c
+			}
+		}(w)
+	}
+	for i := range remote {
+		select {
+		case remote[i] = <-conns:
+		case err := <-errs:
+			b.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	msg := make([]byte, 1024)
+	buf := make([]byte, len(msg))
+
+	b.SetBytes(int64(len(msg) * benchCircuits))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, c := range local {
+			if _, err := c.Write(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for _, c := range remote {
+			if _, err := io.ReadFull(c, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.StopTimer()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/benchCircuits, "heap-B/circuit")
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/benchCircuits, "goroutines/circuit")
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// MaxRelayHops is the maximum number of relays in a chained circuit. Circuits
+// dialed through more relays are refused, and relays refuse to extend a
+// circuit beyond it (or beyond the limit set by the dialer, if lower).
+var MaxRelayHops = 3
+
+// how long relays that confirmed they can hop are trusted to forward chained
+// hop requests
+const verifiedRelayTTL = 10 * time.Minute
+
+// hopChain is the part of a chained circuit that a relay is concerned with.
+type hopChain struct {
+	// the peer the hop request must come from: the source, or the previous
+	// relay of the chain
+	prev peer.ID
+	// the relays left to go through after this one
+	path []peer.AddrInfo
+	// the relays gone through, including this one
+	visited [][]byte
+	maxHops int
+}
+
+// chained returns true if the hop request is part of a chain of relays.
+func chained(msg *pb.CircuitRelay) bool {
+	return len(msg.GetRelayPath()) > 0 || len(msg.GetVisited()) > 0
+}
+
+// relayed returns true if c is itself a relayed connection. Unless chaining
+// is enabled, relays refuse to relay over such connections, as that would
+// silently chain relays.
+func relayed(c network.Conn) bool {
+	_, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// parseChain validates the chain of a hop request from src to dst; on error,
+// it returns the status to refuse the request with.
+func (r *Relay) parseChain(msg *pb.CircuitRelay, src, dst peer.ID) (*hopChain, pb.CircuitRelay_Status, bool) {
+	c := &hopChain{prev: src, maxHops: MaxRelayHops}
+	if !chained(msg) {
+		return c, 0, true
+	}
+
+	if !r.chaining {
+		return nil, pb.CircuitRelay_HOP_CHAIN_DISABLED, false
+	}
+
+	if max := int(msg.GetMaxHops()); max > 0 && max < c.maxHops {
+		c.maxHops = max
+	}
+	if len(msg.GetVisited())+1+len(msg.GetRelayPath()) > c.maxHops {
+		return nil, pb.CircuitRelay_HOP_CHAIN_TOO_LONG, false
+	}
+
+	// a peer may appear only once in the circuit
+	seen := map[peer.ID]struct{}{src: {}, dst: {}, r.self: {}}
+	visit := func(p peer.ID) bool {
+		if _, ok := seen[p]; ok {
+			return false
+		}
+		seen[p] = struct{}{}
+		return true
+	}
+
+	for _, id := range msg.GetVisited() {
+		p, err := peer.IDFromBytes(id)
+		if err != nil {
+			return nil, pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID, false
+		}
+		if !visit(p) {
+			return nil, pb.CircuitRelay_HOP_CHAIN_LOOP, false
+		}
+		c.prev = p
+		c.visited = append(c.visited, id)
+	}
+	c.visited = append(c.visited, []byte(r.self))
+
+	for _, rp := range msg.GetRelayPath() {
+		pi, err := peerToPeerInfo(rp)
+		if err == errAddrTooLong {
+			return nil, pb.CircuitRelay_HOP_DST_ADDR_TOO_LONG, false
+		} else if err != nil {
+			return nil, pb.CircuitRelay_HOP_DST_MULTIADDR_INVALID, false
+		}
+		if !visit(pi.ID) {
+			return nil, pb.CircuitRelay_HOP_CHAIN_LOOP, false
+		}
+		c.path = append(c.path, pi)
+	}
+
+	return c, 0, true
+}
+
+// verifyPrevRelay checks that p, which forwarded a chained hop request, is a
+// hop relay, probing it with CAN_HOP unless it confirmed it recently. Only
+// relays may report the relays a circuit went through; otherwise any peer
+// could claim to relay a circuit and spoof its source.
+func (r *Relay) verifyPrevRelay(ctx context.Context, p peer.ID) bool {
+	now := time.Now()
+
+	r.mx.Lock()
+	verified, ok := r.verifiedRelays[p]
+	r.mx.Unlock()
+	if ok && now.Sub(verified) < verifiedRelayTTL {
+		return true
+	}
+
+	ok, err := CanHop(ctx, r.host, p)
+	if err != nil {
+		log.Debugf("error verifying relay %s: %s", p, err)
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for q, t := range r.verifiedRelays {
+		if now.Sub(t) >= verifiedRelayTTL {
+			delete(r.verifiedRelays, q)
+		}
+	}
+	if ok {
+		r.verifiedRelays[p] = now
+	}
+	return ok
+}
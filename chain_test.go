@@ -0,0 +1,231 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/gogo/protobuf/proto"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func testRelayChain(t *testing.T, n int) {
+	nw := chainTopology(t, relaytest.Hop|relaytest.Chaining, n)
+	src, dst := nw.Nodes[0], nw.Nodes[n+1]
+
+	var relays []peer.AddrInfo
+	for _, node := range nw.Nodes[1 : n+1] {
+		relays = append(relays, peer.AddrInfo{ID: node.Host.ID()})
+	}
+
+	accept := dst.Accept()
+
+	c, err := src.Relay.DialChain(context.Background(), relays, peer.AddrInfo{ID: dst.Host.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := accept()
+	defer dc.Close()
+
+	go io.Copy(dc, dc)
+
+	msg := []byte("chained relay works!")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Fatalf("message was incorrect: %s", buf)
+	}
+
+	for i, node := range nw.Nodes[1 : n+1] {
+		if hops := node.Relay.GetActiveHops(); hops != 1 {
+			t.Fatalf("expected relay %d to have 1 active hop, got %d", i+1, hops)
+		}
+	}
+}
+
+func TestRelayChainTwoRelays(t *testing.T) {
+	testRelayChain(t, 2)
+}
+
+func TestRelayChainThreeRelays(t *testing.T) {
+	testRelayChain(t, 3)
+}
+
+func TestRelayChainDialAddr(t *testing.T) {
+	nw := chainTopology(t, relaytest.Hop|relaytest.Chaining, 2)
+	src, dst := nw.Nodes[0], nw.Nodes[3]
+
+	accept := dst.Accept()
+
+	addr := ma.StringCast(fmt.Sprintf("/p2p/%s/p2p-circuit/p2p/%s/p2p-circuit",
+		nw.Nodes[1].Host.ID().Pretty(), nw.Nodes[2].Host.ID().Pretty()))
+
+	c, err := src.Relay.Dial(context.Background(), addr, dst.Host.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	accept().Close()
+}
+
+func TestRelayChainDisabled(t *testing.T) {
+	nw := chainTopology(t, relaytest.Hop, 2)
+	src, dst := nw.Nodes[0], nw.Nodes[3]
+
+	relays := []peer.AddrInfo{{ID: nw.Nodes[1].Host.ID()}, {ID: nw.Nodes[2].Host.ID()}}
+
+	_, err := src.Relay.DialChain(context.Background(), relays, peer.AddrInfo{ID: dst.Host.ID()})
+	rerr, ok := err.(RelayError)
+	if !ok || rerr.Code != pb.CircuitRelay_HOP_CHAIN_DISABLED {
+		t.Fatalf("expected HOP_CHAIN_DISABLED, got %v", err)
+	}
+
+	// a dialer without OptChaining can't dial chains
+	_, err = dst.Relay.DialChain(context.Background(), relays, peer.AddrInfo{ID: src.Host.ID()})
+	if err == nil {
+		t.Fatal("expected dialing a chain without OptChaining to fail")
+	}
+}
+
+func TestRelayChainLoop(t *testing.T) {
+	nw := chainTopology(t, relaytest.Hop|relaytest.Chaining, 2)
+	src, dst := nw.Nodes[0], nw.Nodes[3]
+
+	a := peer.AddrInfo{ID: nw.Nodes[1].Host.ID()}
+	b := peer.AddrInfo{ID: nw.Nodes[2].Host.ID()}
+
+	_, err := src.Relay.DialChain(context.Background(), []peer.AddrInfo{a, b, a}, peer.AddrInfo{ID: dst.Host.ID()})
+	rerr, ok := err.(RelayError)
+	if !ok || rerr.Code != pb.CircuitRelay_HOP_CHAIN_LOOP {
+		t.Fatalf("expected HOP_CHAIN_LOOP, got %v", err)
+	}
+
+	// a relay that was already visited
+	status := roundtrip(t, src.Host, a.ID, &pb.CircuitRelay{
+		Type:    pb.CircuitRelay_HOP.Enum(),
+		SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(src.Host.ID())},
+		DstPeer: &pb.CircuitRelay_Peer{Id: []byte(dst.Host.ID())},
+		Visited: [][]byte{[]byte(a.ID)},
+	})
+	if status != pb.CircuitRelay_HOP_CHAIN_LOOP {
+		t.Fatalf("expected HOP_CHAIN_LOOP, got %s", status)
+	}
+}
+
+func TestRelayChainTooLong(t *testing.T) {
+	nw := chainTopology(t, relaytest.Hop|relaytest.Chaining, 2)
+	src, dst := nw.Nodes[0], nw.Nodes[3]
+
+	// the dialer's limit is enforced by the relays
+	status := roundtrip(t, src.Host, nw.Nodes[1].Host.ID(), &pb.CircuitRelay{
+		Type:      pb.CircuitRelay_HOP.Enum(),
+		SrcPeer:   &pb.CircuitRelay_Peer{Id: []byte(src.Host.ID())},
+		DstPeer:   &pb.CircuitRelay_Peer{Id: []byte(dst.Host.ID())},
+		RelayPath: []*pb.CircuitRelay_Peer{{Id: []byte(nw.Nodes[2].Host.ID())}},
+		MaxHops:   proto.Uint32(1),
+	})
+	if status != pb.CircuitRelay_HOP_CHAIN_TOO_LONG {
+		t.Fatalf("expected HOP_CHAIN_TOO_LONG, got %s", status)
+	}
+
+	// and so is their own
+	defer func(max int) { MaxRelayHops = max }(MaxRelayHops)
+	MaxRelayHops = 1
+
+	status = roundtrip(t, src.Host, nw.Nodes[1].Host.ID(), &pb.CircuitRelay{
+		Type:      pb.CircuitRelay_HOP.Enum(),
+		SrcPeer:   &pb.CircuitRelay_Peer{Id: []byte(src.Host.ID())},
+		DstPeer:   &pb.CircuitRelay_Peer{Id: []byte(dst.Host.ID())},
+		RelayPath: []*pb.CircuitRelay_Peer{{Id: []byte(nw.Nodes[2].Host.ID())}},
+	})
+	if status != pb.CircuitRelay_HOP_CHAIN_TOO_LONG {
+		t.Fatalf("expected HOP_CHAIN_TOO_LONG, got %s", status)
+	}
+}
+
+func TestRelayChainForgedVisited(t *testing.T) {
+	nw := relaytest.New(t, relaytest.Topology{
+		Nodes: []relaytest.Role{relaytest.Chaining, relaytest.Hop | relaytest.Chaining, relaytest.Client, relaytest.Client},
+		Links: [][2]int{{0, 1}, {1, 2}},
+	})
+	src, victim, dst := nw.Nodes[0], nw.Nodes[3], nw.Nodes[2]
+
+	// a client claims to relay a circuit from another peer
+	msg := hopMsg(victim.Host.ID(), dst.Host.ID())
+	msg.Visited = [][]byte{[]byte(src.Host.ID())}
+
+	status := roundtrip(t, src.Host, nw.Nodes[1].Host.ID(), msg)
+	if status != pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID {
+		t.Fatalf("expected HOP_SRC_MULTIADDR_INVALID, got %s", status)
+	}
+}
+
+// connectRelayed connects node a to node b through node r.
+func connectRelayed(t *testing.T, nw *relaytest.Network, a, r, b int) {
+	circuit := ma.StringCast("/p2p/" + nw.Nodes[r].Host.ID().Pretty() + "/p2p-circuit")
+	pi := peer.AddrInfo{ID: nw.Nodes[b].Host.ID(), Addrs: []ma.Multiaddr{circuit}}
+	if err := nw.Nodes[a].Host.Connect(context.Background(), pi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hopMsg(src, dst peer.ID) *pb.CircuitRelay {
+	return &pb.CircuitRelay{
+		Type:    pb.CircuitRelay_HOP.Enum(),
+		SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(src)},
+		DstPeer: &pb.CircuitRelay_Peer{Id: []byte(dst)},
+	}
+}
+
+func testRecursiveRelayToDst(t *testing.T, role relaytest.Role, expected pb.CircuitRelay_Status) {
+	// the relay can only reach the destination through another relay
+	nw := relaytest.New(t, relaytest.Topology{
+		Nodes: []relaytest.Role{relaytest.Client, role, relaytest.Hop, relaytest.NATed},
+		Links: [][2]int{{0, 1}, {1, 2}, {2, 3}},
+	})
+	connectRelayed(t, nw, 1, 2, 3)
+
+	src, dst := nw.Nodes[0], nw.Nodes[3]
+	status := roundtrip(t, src.Host, nw.Nodes[1].Host.ID(), hopMsg(src.Host.ID(), dst.Host.ID()))
+	if status != expected {
+		t.Fatalf("expected %s, got %s", expected, status)
+	}
+}
+
+func TestRecursiveRelayToDst(t *testing.T) {
+	testRecursiveRelayToDst(t, relaytest.Hop, pb.CircuitRelay_HOP_RECURSIVE_RELAY)
+}
+
+func TestRecursiveRelayToDstChaining(t *testing.T) {
+	testRecursiveRelayToDst(t, relaytest.Hop|relaytest.Chaining, pb.CircuitRelay_SUCCESS)
+}
+
+func TestRecursiveRelayFromSrc(t *testing.T) {
+	// the source can only reach the relay through another relay
+	nw := relaytest.New(t, relaytest.Topology{
+		Nodes: []relaytest.Role{relaytest.NATed, relaytest.Hop, relaytest.Hop, relaytest.Client},
+		Links: [][2]int{{0, 2}, {1, 2}, {1, 3}},
+	})
+	connectRelayed(t, nw, 0, 2, 1)
+
+	src, dst := nw.Nodes[0], nw.Nodes[3]
+	status := roundtrip(t, src.Host, nw.Nodes[1].Host.ID(), hopMsg(src.Host.ID(), dst.Host.ID()))
+	if status != pb.CircuitRelay_HOP_RECURSIVE_RELAY {
+		t.Fatalf("expected HOP_RECURSIVE_RELAY, got %s", status)
+	}
+}
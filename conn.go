@@ -1,8 +1,9 @@
 package relay
 
 import (
-	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/host"
@@ -10,43 +11,157 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	ma "github.com/multiformats/go-multiaddr"
-	manet "github.com/multiformats/go-multiaddr/net"
 )
 
 // HopTagWeight is the connection manager weight for connections carrying relay hop streams
 var HopTagWeight = 5
 
 type Conn struct {
+	// accessed atomically; first for 64-bit alignment
+	bytesRead, bytesWritten uint64
+
 	stream network.Stream
 	remote peer.AddrInfo
 	host   host.Host
 	relay  *Relay
+
+	laddr, raddr ma.Multiaddr
+	lnet, rnet   *NetAddr
+
+	dir    network.Direction
+	opened time.Time
+	// token of the resumable session opened by the connection, if any
+	token []byte
+
+	closeOnce sync.Once
+	// stops the keepalive probes of the relay, if enabled
+	stopKeepalive func()
+
+	mx sync.Mutex
+	// whether the relay connection is tagged for the connection
+	tagged bool
+	// the error the connection failed with, if it was closed by the relay
+	// transport itself
+	err error
 }
 
-type NetAddr struct {
-	Relay  string
-	Remote string
+// newConn returns the relayed connection to remote over s; path lists the
+// relays after the one at the other end of s, for connections going through a
+// chain of relays.
+func (r *Relay) newConn(s network.Stream, dir network.Direction, remote peer.AddrInfo, path []peer.ID) (*Conn, error) {
+	relayAddr, err := circuitTo(s.Conn().RemotePeer())
+	if err != nil {
+		return nil, err
+	}
+	laddr := ma.Join(s.Conn().RemoteMultiaddr(), relayAddr)
+
+	addrs := []ma.Multiaddr{laddr}
+	for _, p := range path {
+		a, err := circuitTo(p)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a)
+	}
+	remoteAddr, err := p2pAddr(remote.ID)
+	if err != nil {
+		return nil, err
+	}
+	raddr := ma.Join(append(addrs, remoteAddr)...)
+
+	lnet, err := NewNetAddr(laddr)
+	if err != nil {
+		return nil, err
+	}
+	rnet, err := NewNetAddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		stream: s,
+		remote: remote,
+		host:   r.host,
+		relay:  r,
+		laddr:  laddr,
+		raddr:  raddr,
+		lnet:   lnet,
+		rnet:   rnet,
+		dir:    dir,
+		opened: time.Now(),
+	}, nil
+}
+
+// Close closes the connection gracefully: data written before is still
+// delivered, and the remote peer reads EOF after it. Use Reset to abort the
+// connection instead.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.stream.Close()
 }
 
-func (n *NetAddr) Network() string {
-	return "libp2p-circuit-relay"
+// CloseWrite closes the connection for writing; the remote peer reads EOF
+// once it has read the data written before. The connection can still be read
+// from.
+func (c *Conn) CloseWrite() error {
+	return c.stream.CloseWrite()
 }
 
-func (n *NetAddr) String() string {
-	return fmt.Sprintf("relay[%s-%s]", n.Remote, n.Relay)
+// CloseRead closes the connection for reading; the connection can still be
+// written to.
+func (c *Conn) CloseRead() error {
+	return c.stream.CloseRead()
 }
 
-func (c *Conn) Close() error {
-	c.untagHop()
+// Reset aborts the connection: data in flight is discarded, and reads and
+// writes on both ends fail.
+func (c *Conn) Reset() error {
+	c.closeOnce.Do(c.release)
 	return c.stream.Reset()
 }
 
+// release releases the resources of the connection when it is closed.
+func (c *Conn) release() {
+	if c.stopKeepalive != nil {
+		c.stopKeepalive()
+	}
+	c.untagHop()
+}
+
+// fail aborts the connection; reads and writes fail with err from then on.
+func (c *Conn) fail(err error) {
+	c.mx.Lock()
+	c.err = err
+	c.mx.Unlock()
+	c.Reset()
+}
+
+// failure returns the error the connection failed with, or err if it did not.
+func (c *Conn) failure(err error) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
 func (c *Conn) Read(buf []byte) (int, error) {
-	return c.stream.Read(buf)
+	n, err := c.stream.Read(buf)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	if err != nil {
+		err = c.failure(err)
+	}
+	return n, err
 }
 
 func (c *Conn) Write(buf []byte) (int, error) {
-	return c.stream.Write(buf)
+	n, err := c.stream.Write(buf)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	if err != nil {
+		err = c.failure(err)
+	}
+	return n, err
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
@@ -61,64 +176,51 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 	return c.stream.SetWriteDeadline(t)
 }
 
+// RemoteAddr returns the NetAddr of RemoteMultiaddr.
 func (c *Conn) RemoteAddr() net.Addr {
-	return &NetAddr{
-		Relay:  c.stream.Conn().RemotePeer().Pretty(),
-		Remote: c.remote.ID.Pretty(),
-	}
+	return c.rnet
 }
 
-// Increment the underlying relay connection tag by 1, thus increasing its protection from
+// Count the connection in the tag of the underlying relay connection, thus protecting it from
 // connection pruning. This ensures that connections to relays are not accidentally closed,
 // by the connection manager, taking with them all the relayed connections (that may themselves
 // be protected).
 func (c *Conn) tagHop() {
-	c.relay.mx.Lock()
-	defer c.relay.mx.Unlock()
+	c.mx.Lock()
+	defer c.mx.Unlock()
 
-	p := c.stream.Conn().RemotePeer()
-	c.relay.hopCount[p]++
-	if c.relay.hopCount[p] == 1 {
-		c.host.ConnManager().TagPeer(p, "relay-hop-stream", HopTagWeight)
+	if !c.tagged {
+		c.relay.tags.acquire(c.stream.Conn().RemotePeer())
+		c.tagged = true
 	}
 }
 
-// Decrement the underlying relay connection tag by 1; this is performed when we close the
-// relayed connection.
+// Uncount the connection from the tag of the underlying relay connection; this is performed
+// when we close the relayed connection.
 func (c *Conn) untagHop() {
-	c.relay.mx.Lock()
-	defer c.relay.mx.Unlock()
-
-	p := c.stream.Conn().RemotePeer()
-	c.relay.hopCount[p]--
-	if c.relay.hopCount[p] == 0 {
-		c.host.ConnManager().UntagPeer(p, "relay-hop-stream")
-		delete(c.relay.hopCount, p)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.tagged {
+		c.relay.tags.release(c.stream.Conn().RemotePeer())
+		c.tagged = false
 	}
 }
 
-// TODO: is it okay to cast c.Conn().RemotePeer() into a multiaddr? might be "user input"
+// RemoteMultiaddr returns the circuit address of the remote peer: the address
+// of the relay, followed by the rest of the chain of relays the connection
+// goes through, if any, and by the remote peer ID.
 func (c *Conn) RemoteMultiaddr() ma.Multiaddr {
-	// TODO: We should be able to do this directly without converting to/from a string.
-	relayAddr, err := ma.NewComponent(
-		ma.ProtocolWithCode(ma.P_P2P).Name,
-		c.stream.Conn().RemotePeer().Pretty(),
-	)
-	if err != nil {
-		panic(err)
-	}
-	return ma.Join(c.stream.Conn().RemoteMultiaddr(), relayAddr, circuitAddr)
+	return c.raddr
 }
 
+// LocalMultiaddr returns the circuit address of the local peer at the relay
+// it is connected to.
 func (c *Conn) LocalMultiaddr() ma.Multiaddr {
-	return c.stream.Conn().LocalMultiaddr()
+	return c.laddr
 }
 
+// LocalAddr returns the NetAddr of LocalMultiaddr.
 func (c *Conn) LocalAddr() net.Addr {
-	na, err := manet.ToNetAddr(c.stream.Conn().LocalMultiaddr())
-	if err != nil {
-		log.Error("failed to convert local multiaddr to net addr:", err)
-		return nil
-	}
-	return na
+	return c.lnet
 }
@@ -0,0 +1,275 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+func checkAddr(t *testing.T, what string, addr ma.Multiaddr, expected string) {
+	t.Helper()
+	if addr == nil || !addr.Equal(ma.StringCast(expected)) {
+		t.Errorf("expected %s to be %s, got %s", what, expected, addr)
+	}
+}
+
+// checkAddrs checks the multiaddrs of c, and that its net.Addrs match them.
+func checkAddrs(t *testing.T, what string, c manet.Conn, local, remote string) {
+	t.Helper()
+	checkAddr(t, what+" local address", c.LocalMultiaddr(), local)
+	checkAddr(t, what+" remote address", c.RemoteMultiaddr(), remote)
+
+	if a := c.LocalAddr(); a == nil || a.String() != local {
+		t.Errorf("expected %s local net address to be %s, got %v", what, local, a)
+	}
+	if a := c.RemoteAddr(); a == nil || a.String() != remote {
+		t.Errorf("expected %s remote net address to be %s, got %v", what, remote, a)
+	}
+
+	// the registered converters handle the addresses of real connections,
+	// which end with the /p2p component of the peer
+	for _, a := range []ma.Multiaddr{c.LocalMultiaddr(), c.RemoteMultiaddr()} {
+		if na, err := manet.ToNetAddr(a); err != nil {
+			t.Errorf("error converting %s address %s: %s", what, a, err)
+		} else if na.String() != a.String() {
+			t.Errorf("expected %s to convert to itself, got %s", a, na)
+		}
+	}
+}
+
+func TestConnMultiaddrs(t *testing.T) {
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	src, rel, dst := nw.Nodes[0].Host.ID(), nw.Nodes[1].Host.ID(), nw.Nodes[2].Host.ID()
+
+	accept := nw.Nodes[2].Accept()
+
+	c, err := nw.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := accept()
+	defer dc.Close()
+
+	// both ends are connected to the relay at its listen address
+	circuit := fmt.Sprintf("/ip4/127.0.0.1/tcp/4002/p2p/%s/p2p-circuit", rel.Pretty())
+
+	checkAddrs(t, "dialer", c, circuit, circuit+"/p2p/"+dst.Pretty())
+	checkAddrs(t, "listener", dc.(manet.Conn), circuit, circuit+"/p2p/"+src.Pretty())
+}
+
+func TestChainedConnMultiaddrs(t *testing.T) {
+	nw := chainTopology(t, relaytest.Hop|relaytest.Chaining, 2)
+	src, r1, r2, dst := nw.Nodes[0].Host.ID(), nw.Nodes[1].Host.ID(), nw.Nodes[2].Host.ID(), nw.Nodes[3].Host.ID()
+
+	accept := nw.Nodes[3].Accept()
+
+	c, err := nw.Nodes[0].Relay.DialChain(context.Background(),
+		[]peer.AddrInfo{{ID: r1}, {ID: r2}}, peer.AddrInfo{ID: dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := accept()
+	defer dc.Close()
+
+	first := fmt.Sprintf("/ip4/127.0.0.1/tcp/4002/p2p/%s/p2p-circuit", r1.Pretty())
+	checkAddrs(t, "dialer", c, first,
+		fmt.Sprintf("%s/p2p/%s/p2p-circuit/p2p/%s", first, r2.Pretty(), dst.Pretty()))
+
+	// the destination only knows of the last relay
+	last := fmt.Sprintf("/ip4/127.0.0.1/tcp/4003/p2p/%s/p2p-circuit", r2.Pretty())
+	checkAddrs(t, "listener", dc.(manet.Conn), last, last+"/p2p/"+src.Pretty())
+}
+
+// relayedPair returns both ends of a connection relayed between two nodes.
+func relayedPair(t *testing.T) (*Conn, *Conn) {
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+
+	accept := nw.Nodes[2].Accept()
+
+	c, err := nw.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Reset() })
+
+	dc := accept()
+	t.Cleanup(func() { dc.(*Conn).Reset() })
+
+	for _, conn := range []net.Conn{c, dc} {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	return c, dc.(*Conn)
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	c, dc := relayedPair(t)
+
+	// a request, and a response once the request is complete
+	request := []byte("request")
+	if _, err := c.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, request) {
+		t.Fatalf("expected %q, got %q", request, got)
+	}
+
+	response := []byte("response")
+	if _, err := dc.Write(response); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Fatalf("expected %q, got %q", response, got)
+	}
+}
+
+func TestConnCloseFlushes(t *testing.T) {
+	c, dc := relayedPair(t)
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	done := make(chan []byte, 1)
+	go func() {
+		got, err := ioutil.ReadAll(dc)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-done; !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes before EOF, got %d", len(data), len(got))
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	c, dc := relayedPair(t)
+
+	if _, err := c.Write([]byte("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, dc); err == nil {
+		t.Fatal("expected reading from a reset connection to fail")
+	}
+}
+
+func TestConnStat(t *testing.T) {
+	c, dc := relayedPair(t)
+
+	msg := []byte("relay works!")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(dc, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range []*Conn{c, dc} {
+		stat, ok := GetConnStat(conn)
+		if !ok {
+			t.Fatal("expected a relay conn stat")
+		}
+		if stat != conn.RelayStat() {
+			t.Fatalf("expected %v, got %v", conn.RelayStat(), stat)
+		}
+		if stat.Opened.IsZero() || time.Since(stat.Opened) > time.Minute {
+			t.Fatalf("unexpected open time %s", stat.Opened)
+		}
+		if !stat.RelayRemoteAddr.Equal(ma.StringCast("/ip4/127.0.0.1/tcp/4002")) {
+			t.Fatalf("unexpected relay address %s", stat.RelayRemoteAddr)
+		}
+	}
+
+	stat := c.RelayStat()
+	if stat.Direction != network.DirOutbound || stat.BytesWritten != uint64(len(msg)) || stat.BytesRead != 0 {
+		t.Fatalf("unexpected dialer stat %+v", stat)
+	}
+	stat = dc.RelayStat()
+	if stat.Direction != network.DirInbound || stat.BytesRead != uint64(len(msg)) || stat.BytesWritten != 0 {
+		t.Fatalf("unexpected listener stat %+v", stat)
+	}
+	if stat.Relay != c.RelayStat().Relay {
+		t.Fatal("expected both ends to go through the same relay")
+	}
+}
+
+func TestUpgradedConnStat(t *testing.T) {
+	nw := relaytest.New(t, relaytest.Topology{
+		Nodes: []relaytest.Role{relaytest.NATed, relaytest.Hop, relaytest.NATed},
+		Links: [][2]int{{0, 1}, {1, 2}},
+	})
+	src, rel, dst := nw.Nodes[0].Host, nw.Nodes[1].Host, nw.Nodes[2].Host
+
+	circuit := ma.StringCast("/p2p/" + rel.ID().Pretty() + "/p2p-circuit")
+	if err := src.Connect(context.Background(), peer.AddrInfo{ID: dst.ID(), Addrs: []ma.Multiaddr{circuit}}); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := src.Network().ConnsToPeer(dst.ID())
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(conns))
+	}
+	stat, ok := GetConnStat(conns[0])
+	if !ok {
+		t.Fatal("expected a relay conn stat on the host connection")
+	}
+	if stat.Relay != rel.ID() || stat.Direction != network.DirOutbound {
+		t.Fatalf("unexpected stat %+v", stat)
+	}
+	if stat.BytesWritten == 0 || stat.BytesRead == 0 {
+		t.Fatalf("expected the upgrade handshake to be accounted for, got %+v", stat)
+	}
+
+	// not relayed
+	if _, ok := GetConnStat(src.Network().ConnsToPeer(rel.ID())[0]); ok {
+		t.Fatal("expected no relay conn stat on a direct connection")
+	}
+}
@@ -16,42 +16,58 @@ func (d *RelayTransport) Dial(ctx context.Context, a ma.Multiaddr, p peer.ID) (t
 	if err != nil {
 		return nil, err
 	}
-	c.tagHop()
 	scope, _ := network.NullResourceManager.OpenConnection(network.DirOutbound, false)
 	return d.upgrader.Upgrade(ctx, d, c, network.DirOutbound, p, scope)
 }
 
 func (r *Relay) Dial(ctx context.Context, a ma.Multiaddr, p peer.ID) (*Conn, error) {
-	// split /a/p2p-circuit/b into (/a, /p2p-circuit/b)
-	relayaddr, destaddr := ma.SplitFunc(a, func(c ma.Component) bool {
-		return c.Protocol().Code == ma.P_CIRCUIT
-	})
+	// split /a/p2p-circuit/b/p2p-circuit/c into the relays (/a, /b) and the
+	// destination (/c)
+	var parts []ma.Multiaddr
+	for rest := a; ; {
+		before, after := ma.SplitFunc(rest, func(c ma.Component) bool {
+			return c.Protocol().Code == ma.P_CIRCUIT
+		})
+		parts = append(parts, before)
 
-	// If the address contained no /p2p-circuit part, the second part is nil.
-	if destaddr == nil {
-		return nil, fmt.Errorf("%s is not a relay address", a)
+		// If the address contained no more /p2p-circuit parts, the second
+		// part is nil.
+		if after == nil {
+			break
+		}
+
+		// Strip the /p2p-circuit prefix.
+		_, rest = ma.SplitFirst(after)
+		if rest == nil {
+			parts = append(parts, nil)
+			break
+		}
 	}
 
-	if relayaddr == nil {
-		return nil, fmt.Errorf(
-			"can't dial a p2p-circuit without specifying a relay: %s",
-			a,
-		)
+	if len(parts) == 1 {
+		return nil, fmt.Errorf("%s is not a relay address", a)
 	}
 
-	// Strip the /p2p-circuit prefix from the destaddr.
-	_, destaddr = ma.SplitFirst(destaddr)
+	relays := make([]peer.AddrInfo, 0, len(parts)-1)
+	for _, relayaddr := range parts[:len(parts)-1] {
+		if relayaddr == nil {
+			return nil, fmt.Errorf(
+				"can't dial a p2p-circuit without specifying a relay: %s",
+				a,
+			)
+		}
 
-	dinfo := &peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{}}
-	if destaddr != nil {
-		dinfo.Addrs = append(dinfo.Addrs, destaddr)
+		rinfo, err := peer.AddrInfoFromP2pAddr(relayaddr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing multiaddr '%s': %s", relayaddr.String(), err)
+		}
+		relays = append(relays, *rinfo)
 	}
 
-	var rinfo *peer.AddrInfo
-	rinfo, err := peer.AddrInfoFromP2pAddr(relayaddr)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing multiaddr '%s': %s", relayaddr.String(), err)
+	dinfo := &peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{}}
+	if destaddr := parts[len(parts)-1]; destaddr != nil {
+		dinfo.Addrs = append(dinfo.Addrs, destaddr)
 	}
 
-	return r.DialPeer(ctx, *rinfo, *dinfo)
+	return r.DialChain(ctx, relays, *dinfo)
 }
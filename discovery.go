@@ -0,0 +1,212 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+// RelayNamespace is the discovery namespace hop relays advertise themselves
+// under.
+const RelayNamespace = "/libp2p/relay"
+
+var (
+	// AdvertiseRetryInterval is how long hop relays wait before advertising
+	// again after advertising failed.
+	AdvertiseRetryInterval = 2 * time.Minute
+	// DiscoveryInterval is the interval between the rounds of discovery of
+	// RelayFinder.Run.
+	DiscoveryInterval = 10 * time.Minute
+	// MaxCandidateRelays is the number of relays, most recently verified
+	// first, kept in the candidate pool of a RelayFinder.
+	MaxCandidateRelays = 16
+	// CanHopTimeout is the time limit for verifying discovered relays.
+	CanHopTimeout = 30 * time.Second
+)
+
+// SetAdvertiser makes the hop relay advertise itself under RelayNamespace
+// through a, renewing the advertisement before it expires, until the relay is
+// closed. Advertising starts right away, and later calls replace the
+// advertiser rather than advertising twice. It requires OptHop.
+func (r *Relay) SetAdvertiser(a discovery.Advertiser) error {
+	if !r.hop {
+		return errors.New("can't advertise a relay without OptHop")
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.advertiser = a
+	if !r.advertising {
+		r.advertising = true
+		go r.advertise(AdvertiseRetryInterval)
+		return nil
+	}
+	select {
+	case r.readvertise <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// advertise advertises the relay through its current advertiser until the
+// relay is closed, waiting retry after failures.
+func (r *Relay) advertise(retry time.Duration) {
+	for {
+		r.mx.Lock()
+		a := r.advertiser
+		r.mx.Unlock()
+
+		wait := retry
+		ttl, err := a.Advertise(r.ctx, RelayNamespace)
+		switch {
+		case err != nil:
+			log.Debugf("error advertising relay: %s", err)
+		case ttl > 0:
+			// renew the advertisement before it expires
+			wait = ttl * 7 / 8
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-r.readvertise:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// RelayFinder discovers hop relays through a discovery.Discoverer, and keeps
+// those that confirm they can hop in a pool of candidates.
+type RelayFinder struct {
+	relay *Relay
+	d     discovery.Discoverer
+
+	mx         sync.Mutex
+	candidates map[peer.ID]time.Time
+}
+
+// NewRelayFinder returns a finder of relays for r, discovered through d.
+func NewRelayFinder(r *Relay, d discovery.Discoverer) *RelayFinder {
+	return &RelayFinder{
+		relay:      r,
+		d:          d,
+		candidates: make(map[peer.ID]time.Time),
+	}
+}
+
+// Find runs a round of discovery: it looks for up to MaxCandidateRelays
+// relays, and adds those that confirm they can hop to the candidates. Relays
+// that don't are removed.
+func (f *RelayFinder) Find(ctx context.Context) error {
+	peers, err := f.d.FindPeers(ctx, RelayNamespace, discovery.Limit(MaxCandidateRelays))
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for pi := range peers {
+		if pi.ID == f.relay.self || pi.ID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			f.verify(ctx, pi)
+		}(pi)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// verify adds relay pi to the candidates if it can hop, and removes it
+// otherwise.
+func (f *RelayFinder) verify(ctx context.Context, pi peer.AddrInfo) {
+	ctx, cancel := context.WithTimeout(ctx, CanHopTimeout)
+	defer cancel()
+
+	h := f.relay.host
+	if len(pi.Addrs) > 0 {
+		h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+	}
+
+	ok, err := CanHop(ctx, h, pi.ID)
+	if err != nil {
+		log.Debugf("error verifying discovered relay %s: %s", pi.ID, err)
+	}
+
+	if !ok {
+		f.Remove(pi.ID)
+		return
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.candidates[pi.ID] = time.Now()
+	if ids := f.sorted(); len(ids) > MaxCandidateRelays {
+		for _, p := range ids[MaxCandidateRelays:] {
+			delete(f.candidates, p)
+		}
+	}
+}
+
+// Run finds relays every DiscoveryInterval until ctx is done.
+func (f *RelayFinder) Run(ctx context.Context) {
+	ticker := time.NewTicker(DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.Find(ctx); err != nil {
+			log.Debugf("error discovering relays: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sorted returns the candidates, most recently verified first; f.mx must be
+// held.
+func (f *RelayFinder) sorted() []peer.ID {
+	ids := make([]peer.ID, 0, len(f.candidates))
+	for p := range f.candidates {
+		ids = append(ids, p)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return f.candidates[ids[i]].After(f.candidates[ids[j]])
+	})
+	return ids
+}
+
+// Candidates returns the candidate relays, most recently verified first.
+func (f *RelayFinder) Candidates() []peer.AddrInfo {
+	f.mx.Lock()
+	ids := f.sorted()
+	f.mx.Unlock()
+
+	relays := make([]peer.AddrInfo, 0, len(ids))
+	for _, p := range ids {
+		relays = append(relays, f.relay.host.Peerstore().PeerInfo(p))
+	}
+	return relays
+}
+
+// Remove removes relay p from the candidates, for instance after it failed to
+// relay a connection.
+func (f *RelayFinder) Remove(p peer.ID) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	delete(f.candidates, p)
+}
@@ -0,0 +1,137 @@
+package relay_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// waitAdvertised waits for n peers to be advertised under RelayNamespace.
+func waitAdvertised(t *testing.T, d discovery.Discoverer, n int) map[peer.ID]bool {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ch, err := d.FindPeers(context.Background(), RelayNamespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[peer.ID]bool)
+		for pi := range ch {
+			found[pi.ID] = true
+		}
+		if len(found) == n {
+			return found
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d advertised relays, got %d", n, len(found))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayDiscovery(t *testing.T) {
+	nw := discoveryTopology(t)
+	d := relaytest.NewDiscovery()
+
+	for _, node := range nw.Nodes[1:3] {
+		if err := node.Relay.SetAdvertiser(d.Client(node.Host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// clients can't advertise themselves as relays
+	client := nw.Nodes[3]
+	if err := client.Relay.SetAdvertiser(d.Client(client.Host)); err == nil {
+		t.Fatal("expected advertising a relay without OptHop to fail")
+	}
+	// unless they go around the relay; they are weeded out by CanHop
+	if _, err := d.Client(client.Host).Advertise(context.Background(), RelayNamespace); err != nil {
+		t.Fatal(err)
+	}
+
+	waitAdvertised(t, d.Client(nw.Nodes[0].Host), 3)
+
+	f := NewRelayFinder(nw.Nodes[0].Relay, d.Client(nw.Nodes[0].Host))
+	if err := f.Find(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := make(map[peer.ID]bool)
+	for _, pi := range f.Candidates() {
+		candidates[pi.ID] = true
+	}
+	if len(candidates) != 2 || !candidates[nw.Nodes[1].Host.ID()] || !candidates[nw.Nodes[2].Host.ID()] {
+		t.Fatalf("expected the two relays to be candidates, got %v", f.Candidates())
+	}
+
+	f.Remove(nw.Nodes[1].Host.ID())
+	if relays := f.Candidates(); len(relays) != 1 || relays[0].ID != nw.Nodes[2].Host.ID() {
+		t.Fatalf("expected the second relay to be the only candidate, got %v", relays)
+	}
+}
+
+func TestRelayAdvertiseRenewal(t *testing.T) {
+	nw := discoveryTopology(t)
+	d := relaytest.NewDiscovery()
+	d.TTL = 100 * time.Millisecond
+
+	if err := nw.Nodes[1].Relay.SetAdvertiser(d.Client(nw.Nodes[1].Host)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the advertisement outlives its TTL
+	time.Sleep(5 * d.TTL)
+	found := waitAdvertised(t, d.Client(nw.Nodes[0].Host), 1)
+	if !found[nw.Nodes[1].Host.ID()] {
+		t.Fatalf("expected the relay to be advertised, got %v", found)
+	}
+}
+
+// countingAdvertiser counts the advertisements made through it.
+type countingAdvertiser struct {
+	discovery.Advertiser
+	n int32
+}
+
+func (a *countingAdvertiser) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	atomic.AddInt32(&a.n, 1)
+	return a.Advertiser.Advertise(ctx, ns, opts...)
+}
+
+func TestRelaySetAdvertiserTwice(t *testing.T) {
+	nw := discoveryTopology(t)
+	d := relaytest.NewDiscovery()
+	d.TTL = 50 * time.Millisecond
+	r := nw.Nodes[1]
+
+	first := &countingAdvertiser{Advertiser: d.Client(r.Host)}
+	if err := r.Relay.SetAdvertiser(first); err != nil {
+		t.Fatal(err)
+	}
+	waitAdvertised(t, d.Client(nw.Nodes[0].Host), 1)
+
+	second := &countingAdvertiser{Advertiser: d.Client(r.Host)}
+	if err := r.Relay.SetAdvertiser(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a single advertising loop renews the advertisement, through the second
+	// advertiser only
+	time.Sleep(2 * d.TTL)
+	n := atomic.LoadInt32(&first.n)
+	time.Sleep(4 * d.TTL)
+	if atomic.LoadInt32(&first.n) != n {
+		t.Fatal("expected the replaced advertiser to be no longer used")
+	}
+	if n := atomic.LoadInt32(&second.n); n < 2 {
+		t.Fatalf("expected the advertisement to be renewed, got %d advertisements", n)
+	}
+}
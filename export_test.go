@@ -0,0 +1,20 @@
+package relay
+
+import (
+	"io"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+// UseCopyBuffer makes hop relays copy circuits with io.CopyBuffer and a
+// pooled buffer of HopStreamBufferSize, the copy engine that predates
+// adaptive buffers, until the returned function is called. It is the baseline
+// of the throughput benchmarks.
+func UseCopyBuffer() func() {
+	relayStream = func(dst io.Writer, src io.Reader) (int64, error) {
+		buf := pool.Get(HopStreamBufferSize)
+		defer pool.Put(buf)
+		return io.CopyBuffer(dst, src, buf)
+	}
+	return func() { relayStream = adaptiveCopy }
+}
@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pool "github.com/libp2p/go-buffer-pool"
+)
+
+var (
+	// HopStreamMinBufferSize and HopStreamMaxBufferSize bound the copy
+	// buffer of a relayed circuit. Each direction of a circuit starts with a
+	// buffer of HopStreamBufferSize, grows it while reads fill it and shrinks
+	// it while reads stay small.
+	HopStreamMinBufferSize = 512
+	HopStreamMaxBufferSize = 64 * 1024
+
+	// HopBufferBudget caps the total bytes of copy buffers across all live
+	// circuits. While the budget is exhausted, buffers stop growing, new
+	// circuits start with buffers of HopStreamMinBufferSize, and hop requests
+	// are refused once even those don't fit.
+	HopBufferBudget int64 = 256 << 20
+
+	// HopIdleTimeout is the period after which a relayed circuit with no
+	// traffic in either direction is closed. It is disabled (0) by default,
+	// as relayed protocols may legitimately stay silent for long; hop relays
+	// set it, e.g. to 10 minutes, before relaying circuits to reclaim those
+	// abandoned by their peers.
+	HopIdleTimeout time.Duration
+)
+
+// number of consecutive small reads after which a copy buffer is shrunk
+const shrinkAfterReads = 8
+
+var (
+	errInvalidWrite = errors.New("invalid write result")
+	errCircuitIdle  = errors.New("circuit idle timeout")
+	errHopBudget    = errors.New("hop buffer budget exhausted")
+)
+
+// total bytes of live copy buffers
+var hopBufferBytes int64
+
+// getHopBuffer returns nil if the buffer would exceed HopBufferBudget.
+func getHopBuffer(size int) []byte {
+	if atomic.AddInt64(&hopBufferBytes, int64(size)) > HopBufferBudget {
+		atomic.AddInt64(&hopBufferBytes, -int64(size))
+		return nil
+	}
+	return pool.Get(size)
+}
+
+func putHopBuffer(buf []byte) {
+	atomic.AddInt64(&hopBufferBytes, -int64(len(buf)))
+	pool.Put(buf)
+}
+
+// hopBufferAvailable reports whether a new circuit fits in HopBufferBudget
+// with the smallest buffers in both directions.
+func hopBufferAvailable() bool {
+	return atomic.LoadInt64(&hopBufferBytes)+2*int64(HopStreamMinBufferSize) <= HopBufferBudget
+}
+
+// relayStream copies data from src to dst until EOF or an error, through an
+// adaptive pooled buffer. It is a variable so that benchmarks can compare it
+// with other copy engines.
+var relayStream = adaptiveCopy
+
+// adaptiveCopy is io.CopyBuffer with a buffer that is resized (within the
+// configured bounds and budget) based on the observed read sizes.
+func adaptiveCopy(dst io.Writer, src io.Reader) (written int64, err error) {
+	size := HopStreamBufferSize
+	if size < HopStreamMinBufferSize {
+		size = HopStreamMinBufferSize
+	} else if size > HopStreamMaxBufferSize {
+		size = HopStreamMaxBufferSize
+	}
+
+	buf := getHopBuffer(size)
+	if buf == nil {
+		buf = getHopBuffer(HopStreamMinBufferSize)
+	}
+	if buf == nil {
+		return 0, errHopBudget
+	}
+	defer func() { putHopBuffer(buf) }()
+
+	small := 0
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = errInvalidWrite
+				}
+			}
+			written += int64(nw)
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return written, err
+		}
+
+		switch {
+		case nr == len(buf) && 2*len(buf) <= HopStreamMaxBufferSize:
+			small = 0
+			if nb := getHopBuffer(2 * len(buf)); nb != nil {
+				putHopBuffer(buf)
+				buf = nb
+			}
+		case nr <= len(buf)/4 && len(buf)/2 >= HopStreamMinBufferSize:
+			small++
+			if small >= shrinkAfterReads {
+				small = 0
+				if nb := getHopBuffer(len(buf) / 2); nb != nil {
+					putHopBuffer(buf)
+					buf = nb
+				}
+			}
+		default:
+			small = 0
+		}
+	}
+}
+
+// circuit is a relayed connection between two hop streams.
+type circuit struct {
+	a, b network.Stream
+
+	// the scheduler the circuit's writes go through if a bandwidth limit is
+	// set, and the peer they are accounted to
+	sched *scheduler
+	peer  peer.ID
+
+	// the traffic of the peers at both ends, for connection manager tags
+	traffic []*hopTraffic
+
+	timeout time.Duration
+	// unix nanos of the last read on either side
+	lastActivity int64
+	idle         int32
+
+	mx      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func newCircuit(a, b network.Stream, sched *scheduler, p peer.ID) *circuit {
+	c := &circuit{a: a, b: b, timeout: HopIdleTimeout, peer: p}
+	if sched.limited() {
+		c.sched = sched
+	}
+	if c.timeout > 0 {
+		c.lastActivity = time.Now().UnixNano()
+		c.timer = time.AfterFunc(c.timeout, c.checkIdle)
+	}
+	return c
+}
+
+// copy relays data from src to dst. It returns errCircuitIdle if the circuit
+// was closed because of the idle timeout.
+func (c *circuit) copy(dst, src network.Stream) (int64, error) {
+	var w io.Writer = dst
+	if c.sched != nil {
+		w = &scheduledWriter{w: dst, sched: c.sched, peer: c.peer}
+	}
+
+	var r io.Reader = src
+	if c.timeout > 0 {
+		r = &activityReader{r: src, c: c}
+	}
+	if len(c.traffic) > 0 {
+		r = &trafficReader{r: r, traffic: c.traffic}
+	}
+
+	count, err := relayStream(w, r)
+
+	if atomic.LoadInt32(&c.idle) == 1 {
+		return count, errCircuitIdle
+	}
+	return count, err
+}
+
+func (c *circuit) checkIdle() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+	if idle < c.timeout {
+		c.timer.Reset(c.timeout - idle)
+		return
+	}
+
+	atomic.StoreInt32(&c.idle, 1)
+
+	// signal EOF to both sides before tearing down the streams, so that
+	// pending copies end without resetting them.
+	c.a.CloseWrite()
+	c.b.CloseWrite()
+	c.a.Close()
+	c.b.Close()
+}
+
+// stop disarms the idle timer; it must be called once both copies are done.
+func (c *circuit) stop() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.stopped = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// activityReader records reads in the circuit's last activity time.
+type activityReader struct {
+	r io.Reader
+	c *circuit
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&a.c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func TestRelayStream(t *testing.T) {
+	data := make([]byte, 3*HopStreamBufferSize+7)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	var out bytes.Buffer
+	n, err := relayStream(onlyWriter{&out}, onlyReader{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("relayed data mismatch")
+	}
+}
+
+// chunkReader returns at most chunk bytes per read and records the size of
+// the largest buffer passed to Read.
+type chunkReader struct {
+	data    []byte
+	chunk   int
+	lastBuf int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	r.lastBuf = len(p)
+	n := len(p)
+	if n > r.chunk {
+		n = r.chunk
+	}
+	n = copy(p, r.data[:min(n, len(r.data))])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestAdaptiveCopy(t *testing.T) {
+	// bulk transfers grow the buffer up to the maximum
+	bulk := &chunkReader{data: make([]byte, 1<<20), chunk: 1 << 30}
+	if _, err := relayStream(onlyWriter{io.Discard}, bulk); err != nil {
+		t.Fatal(err)
+	}
+	if bulk.lastBuf != HopStreamMaxBufferSize {
+		t.Fatalf("expected the buffer to grow to %d, got %d", HopStreamMaxBufferSize, bulk.lastBuf)
+	}
+
+	// small reads shrink it down to the minimum
+	chat := &chunkReader{data: make([]byte, 1<<12), chunk: 16}
+	if _, err := relayStream(onlyWriter{io.Discard}, chat); err != nil {
+		t.Fatal(err)
+	}
+	if chat.lastBuf != HopStreamMinBufferSize {
+		t.Fatalf("expected the buffer to shrink to %d, got %d", HopStreamMinBufferSize, chat.lastBuf)
+	}
+}
+
+func TestAdaptiveCopyBudget(t *testing.T) {
+	// buffers of circuits left over by other tests
+	base := atomic.LoadInt64(&hopBufferBytes)
+
+	budget := HopBufferBudget
+	HopBufferBudget = base + int64(2*HopStreamBufferSize)
+	defer func() { HopBufferBudget = budget }()
+
+	// another circuit holds a buffer
+	buf := getHopBuffer(HopStreamBufferSize)
+	defer putHopBuffer(buf)
+
+	bulk := &chunkReader{data: make([]byte, 1<<20), chunk: 1 << 30}
+	if _, err := relayStream(onlyWriter{io.Discard}, bulk); err != nil {
+		t.Fatal(err)
+	}
+	if bulk.lastBuf != HopStreamBufferSize {
+		t.Fatalf("expected the buffer to stay at %d, got %d", HopStreamBufferSize, bulk.lastBuf)
+	}
+}
+
+func TestAdaptiveCopyBudgetExhausted(t *testing.T) {
+	// buffers of circuits left over by other tests
+	base := atomic.LoadInt64(&hopBufferBytes)
+
+	budget := HopBufferBudget
+	HopBufferBudget = base + int64(2*HopStreamBufferSize+HopStreamMinBufferSize)
+	defer func() { HopBufferBudget = budget }()
+
+	// more circuits than the budget allows: the first two get full buffers,
+	// the third the smallest one, and the fourth none
+	var writers []*io.PipeWriter
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		used := atomic.LoadInt64(&hopBufferBytes)
+		go func() {
+			_, err := relayStream(onlyWriter{io.Discard}, pr)
+			errs <- err
+		}()
+		for atomic.LoadInt64(&hopBufferBytes) == used && len(errs) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := <-errs; err != errHopBudget {
+		t.Fatalf("expected the last circuit to fail with %q, got %v", errHopBudget, err)
+	}
+	if used := atomic.LoadInt64(&hopBufferBytes); used != HopBufferBudget {
+		t.Fatalf("expected the circuits to use the whole budget of %d bytes, got %d", HopBufferBudget, used)
+	}
+	if hopBufferAvailable() {
+		t.Fatal("expected new circuits to be refused")
+	}
+
+	for _, pw := range writers {
+		pw.Close()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used := atomic.LoadInt64(&hopBufferBytes); used != base {
+		t.Fatalf("expected the buffers to be released, got %d bytes in use", used-base)
+	}
+}
@@ -0,0 +1,217 @@
+//go:build go1.18
+// +build go1.18
+
+package relay
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	"github.com/libp2p/go-msgio/protoio"
+
+	"github.com/gogo/protobuf/proto"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	fuzzSrc = peer.ID("\x00\x04src1")
+	fuzzDst = peer.ID("\x00\x04dst1")
+)
+
+func delimited(t testing.TB, msg proto.Message) []byte {
+	var buf bytes.Buffer
+	if err := protoio.NewDelimitedWriter(&buf).WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func fuzzSeeds(f *testing.F) {
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001").Bytes()
+	for _, msg := range []*pb.CircuitRelay{
+		{Type: pb.CircuitRelay_CAN_HOP.Enum()},
+		{
+			Type:    pb.CircuitRelay_HOP.Enum(),
+			SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(fuzzSrc), Addrs: [][]byte{addr}},
+			DstPeer: &pb.CircuitRelay_Peer{Id: []byte(fuzzDst), Addrs: [][]byte{addr}},
+		},
+		{
+			Type:    pb.CircuitRelay_STOP.Enum(),
+			SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(fuzzSrc), Addrs: [][]byte{addr}},
+			DstPeer: &pb.CircuitRelay_Peer{Id: []byte(fuzzDst)},
+		},
+	} {
+		f.Add(delimited(f, msg))
+	}
+
+	// varint edge cases
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x80})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{0x80, 0x00})
+
+	// maxMessageSize boundary and truncated payloads
+	f.Add(append(varint.ToUvarint(maxMessageSize), make([]byte, maxMessageSize)...))
+	f.Add(append(varint.ToUvarint(maxMessageSize+1), make([]byte, maxMessageSize+1)...))
+	f.Add(append(varint.ToUvarint(16), make([]byte, 8)...))
+}
+
+func FuzzDelimitedReader(f *testing.F) {
+	fuzzSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		rd := newDelimitedReader(r, maxMessageSize)
+		defer rd.Close()
+
+		var msg pb.CircuitRelay
+		if err := rd.ReadMsg(&msg); err != nil {
+			return
+		}
+
+		mlen, n, err := varint.FromUvarint(data)
+		if err != nil {
+			t.Fatalf("read a message with an invalid length prefix: %s", err)
+		}
+		if mlen > maxMessageSize {
+			t.Fatalf("read a message of %d bytes", mlen)
+		}
+
+		// whatever the reader consumed past the message must be buffered
+		end := n + int(mlen)
+		consumed := len(data) - r.Len()
+		if consumed < end || !bytes.Equal(rd.Buffered(), data[end:consumed]) {
+			t.Fatalf("consumed %d bytes for a %d byte message, buffered %d", consumed, end, len(rd.Buffered()))
+		}
+	})
+}
+
+func FuzzPeerToPeerInfo(f *testing.F) {
+	for _, p := range []*pb.CircuitRelay_Peer{
+		{Id: []byte(fuzzSrc)},
+		{Id: []byte(fuzzSrc), Addrs: [][]byte{ma.StringCast("/ip4/1.2.3.4/tcp/4001").Bytes(), {0x04}}},
+		{Id: []byte("not a peer id")},
+	} {
+		data, err := proto.Marshal(p)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p pb.CircuitRelay_Peer
+		if err := proto.Unmarshal(data, &p); err != nil {
+			return
+		}
+
+		pi, err := peerToPeerInfo(&p)
+		if err != nil {
+			return
+		}
+
+		if !bytes.Equal([]byte(pi.ID), p.Id) {
+			t.Fatalf("peer ID mismatch: %x != %x", []byte(pi.ID), p.Id)
+		}
+		if len(pi.Addrs) > len(p.Addrs) || len(pi.Addrs) > MaxPeerAddrs {
+			t.Fatalf("got %d addresses from %d", len(pi.Addrs), len(p.Addrs))
+		}
+		for _, a := range pi.Addrs {
+			if len(a.Bytes()) > MaxAddrLength {
+				t.Fatalf("got an address of %d bytes", len(a.Bytes()))
+			}
+		}
+	})
+}
+
+// fuzzHost is the subset of a host used by the relay stream handlers. It has
+// no connections, so hop requests fail to open the destination stream.
+type fuzzHost struct {
+	host.Host
+	ps peerstore.Peerstore
+}
+
+func (h *fuzzHost) ID() peer.ID                    { return fuzzDst }
+func (h *fuzzHost) Peerstore() peerstore.Peerstore { return h.ps }
+
+func (h *fuzzHost) NewStream(context.Context, peer.ID, ...protocol.ID) (network.Stream, error) {
+	return nil, network.ErrNoConn
+}
+
+type fuzzConn struct {
+	network.Conn
+}
+
+func (c *fuzzConn) RemotePeer() peer.ID           { return fuzzSrc }
+func (c *fuzzConn) RemoteMultiaddr() ma.Multiaddr { return ma.StringCast("/ip4/1.2.3.4/tcp/4001") }
+
+// fuzzStream reads the fuzz input and discards writes.
+type fuzzStream struct {
+	network.Stream
+	r *bytes.Reader
+}
+
+func (s *fuzzStream) Read(p []byte) (int, error)       { return s.r.Read(p) }
+func (s *fuzzStream) Write(p []byte) (int, error)      { return len(p), nil }
+func (s *fuzzStream) Close() error                     { return nil }
+func (s *fuzzStream) CloseWrite() error                { return nil }
+func (s *fuzzStream) CloseRead() error                 { return nil }
+func (s *fuzzStream) Reset() error                     { return nil }
+func (s *fuzzStream) SetDeadline(time.Time) error      { return nil }
+func (s *fuzzStream) SetReadDeadline(time.Time) error  { return nil }
+func (s *fuzzStream) SetWriteDeadline(time.Time) error { return nil }
+func (s *fuzzStream) Conn() network.Conn               { return &fuzzConn{} }
+
+func FuzzHandleNewStream(f *testing.F) {
+	fuzzSeeds(f)
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer ps.Close()
+
+	r := newRelay(&fuzzHost{ps: ps}, nil)
+	defer r.ctxCancel()
+	r.hop = true
+
+	// accept (and drop) relayed connections
+	go func() {
+		for {
+			select {
+			case c := <-r.incoming:
+				c.stream.Reset()
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r.scores.clear()
+		goroutines := runtime.NumGoroutine()
+
+		r.handleNewStream(&fuzzStream{r: bytes.NewReader(data)})
+
+		for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+			if i == 100 {
+				t.Fatalf("leaked %d goroutines", runtime.NumGoroutine()-goroutines)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
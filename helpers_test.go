@@ -0,0 +1,43 @@
+package relay_test
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+)
+
+// chainTopology sets up src -[relay 1]-> ... -[relay n]-> dst, with each node
+// linked to its neighbours only.
+func chainTopology(t *testing.T, relayRole relaytest.Role, n int) *relaytest.Network {
+	roles := []relaytest.Role{relaytest.Chaining}
+	for i := 0; i < n; i++ {
+		roles = append(roles, relayRole)
+	}
+	roles = append(roles, relaytest.Client)
+	return relaytest.New(t, relaytest.Line(roles...))
+}
+
+// resumableTopology sets up a source and a destination with two relays
+// between them.
+func resumableTopology(t *testing.T, dstRole relaytest.Role) *relaytest.Network {
+	return relaytest.New(t, relaytest.Topology{
+		Nodes: []relaytest.Role{
+			relaytest.Resumable,
+			relaytest.Hop,
+			relaytest.Hop,
+			dstRole,
+		},
+		Links:            [][2]int{{0, 1}, {0, 2}, {1, 3}, {2, 3}},
+		NoRelayTransport: true,
+	})
+}
+
+// discoveryTopology sets up a client linked to two relays and to another
+// client.
+func discoveryTopology(t *testing.T) *relaytest.Network {
+	return relaytest.New(t, relaytest.Topology{
+		Nodes:            []relaytest.Role{relaytest.Client, relaytest.Hop, relaytest.Hop, relaytest.Client},
+		Links:            [][2]int{{0, 1}, {0, 2}, {0, 3}},
+		NoRelayTransport: true,
+	})
+}
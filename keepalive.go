@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// ErrRelayUnreachable is the error of relayed connections closed because the
+// relay stopped answering keepalive probes.
+var ErrRelayUnreachable = errors.New("relay unreachable: keepalive probes failed")
+
+// SetKeepalive enables liveness probing of the connections carrying circuits:
+// every interval, relayed connections probe the relay they go through, and
+// hop relays probe both ends of the circuits they relay. After maxFailures
+// consecutive failed probes the circuit is reset, and the relayed connection
+// fails with ErrRelayUnreachable. A zero interval, the default, disables
+// probing. It should be called before the relay starts dialing and accepting
+// connections.
+func (r *Relay) SetKeepalive(interval time.Duration, maxFailures int) {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	r.kaInterval = interval
+	r.kaFailures = maxFailures
+}
+
+// keepalive probes the peer at the other end of c every interval, until ctx
+// is done or maxFailures consecutive probes fail, in which case it returns
+// ErrRelayUnreachable.
+func keepalive(ctx context.Context, c network.Conn, interval time.Duration, maxFailures int) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, interval)
+		err := probe(pctx, c)
+		cancel()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		log.Debugf("keepalive probe to %s failed (%d/%d): %s", c.RemotePeer(), failures, maxFailures, err)
+		if failures >= maxFailures {
+			return ErrRelayUnreachable
+		}
+	}
+}
+
+// probe checks that the peer at the other end of c is alive with a CAN_HOP
+// roundtrip; any answer will do.
+func probe(ctx context.Context, c network.Conn) error {
+	s, err := c.NewStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	s.SetProtocol(ProtoID)
+	if err := msmux.SelectProtoOrFail(string(ProtoID), s); err != nil {
+		s.Reset()
+		return err
+	}
+
+	if _, err := canHop(s); err != nil {
+		s.Reset()
+		return err
+	}
+	return s.Close()
+}
+
+// prober runs a single keepalive loop per connection carrying circuits,
+// however many circuits it carries, and fails them all when its peer is
+// unreachable.
+type prober struct {
+	mx    sync.Mutex
+	conns map[network.Conn]*probedConn
+}
+
+type probedConn struct {
+	cancel   context.CancelFunc
+	watchers map[int]func(error)
+	next     int
+}
+
+func newProber() *prober {
+	return &prober{conns: make(map[network.Conn]*probedConn)}
+}
+
+// watch calls onFail with ErrRelayUnreachable if the peer at the other end of
+// c stops answering keepalive probes, until the returned function is called.
+func (r *Relay) watch(c network.Conn, onFail func(error)) func() {
+	pr := r.probes
+
+	pr.mx.Lock()
+	defer pr.mx.Unlock()
+
+	pc, ok := pr.conns[c]
+	if !ok {
+		ctx, cancel := context.WithCancel(r.ctx)
+		pc = &probedConn{cancel: cancel, watchers: make(map[int]func(error))}
+		pr.conns[c] = pc
+		go func() {
+			if err := keepalive(ctx, c, r.kaInterval, r.kaFailures); err != nil {
+				pr.fail(c, pc, err)
+			}
+		}()
+	}
+	id := pc.next
+	pc.next++
+	pc.watchers[id] = onFail
+
+	return func() {
+		pr.mx.Lock()
+		defer pr.mx.Unlock()
+
+		delete(pc.watchers, id)
+		if len(pc.watchers) == 0 && pr.conns[c] == pc {
+			pc.cancel()
+			delete(pr.conns, c)
+		}
+	}
+}
+
+// fail fans the failure of the probes of c out to its watchers.
+func (pr *prober) fail(c network.Conn, pc *probedConn, err error) {
+	pr.mx.Lock()
+	if pr.conns[c] == pc {
+		delete(pr.conns, c)
+	}
+	watchers := make([]func(error), 0, len(pc.watchers))
+	for _, f := range pc.watchers {
+		watchers = append(watchers, f)
+	}
+	pr.mx.Unlock()
+
+	for _, f := range watchers {
+		f(err)
+	}
+}
+
+// startKeepalive probes the relay of c, if enabled, until c is closed.
+func (c *Conn) startKeepalive() {
+	r := c.relay
+	if r.kaInterval <= 0 {
+		return
+	}
+
+	c.stopKeepalive = r.watch(c.stream.Conn(), func(err error) {
+		log.Infof("closing relayed connection to %s: %s", c.remote.ID, err)
+		c.fail(err)
+	})
+}
+
+// keepaliveCircuit probes both ends of the circuit between s and bs, if
+// enabled, until the returned function is called, and resets the circuit when
+// either end is unreachable.
+func (r *Relay) keepaliveCircuit(s, bs network.Stream) func() {
+	if r.kaInterval <= 0 {
+		return func() {}
+	}
+
+	var stops []func()
+	for _, c := range []network.Conn{s.Conn(), bs.Conn()} {
+		c := c
+		stops = append(stops, r.watch(c, func(error) {
+			log.Infof("resetting circuit: %s is unreachable", c.RemotePeer())
+			s.Reset()
+			bs.Reset()
+		}))
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// deadConn is a connection whose peer never answers.
+type deadConn struct {
+	network.Conn
+	streams int32
+}
+
+func (c *deadConn) NewStream(context.Context) (network.Stream, error) {
+	atomic.AddInt32(&c.streams, 1)
+	return nil, errors.New("dead")
+}
+
+func (c *deadConn) RemotePeer() peer.ID { return "dead" }
+
+func TestKeepaliveSharedProbes(t *testing.T) {
+	r := newRelay(&fuzzHost{}, nil)
+	defer r.ctxCancel()
+	r.SetKeepalive(10*time.Millisecond, 3)
+
+	c := &deadConn{}
+	failed := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		defer r.watch(c, func(err error) { failed <- err })()
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-failed:
+			if err != ErrRelayUnreachable {
+				t.Fatalf("expected ErrRelayUnreachable, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected every watcher to fail")
+		}
+	}
+
+	// the circuits on the connection share a single probe loop
+	if n := atomic.LoadInt32(&c.streams); n != 3 {
+		t.Fatalf("expected 3 probes, got %d", n)
+	}
+
+	r.probes.mx.Lock()
+	defer r.probes.mx.Unlock()
+	if len(r.probes.conns) != 0 {
+		t.Fatalf("expected the failed connection to be forgotten, got %d", len(r.probes.conns))
+	}
+}
+
+func TestKeepaliveStopsUnwatched(t *testing.T) {
+	r := newRelay(&fuzzHost{}, nil)
+	defer r.ctxCancel()
+	r.SetKeepalive(10*time.Millisecond, 1000)
+
+	c := &deadConn{}
+	stop1 := r.watch(c, func(error) {})
+	stop2 := r.watch(c, func(error) {})
+
+	stop1()
+	r.probes.mx.Lock()
+	n := len(r.probes.conns)
+	r.probes.mx.Unlock()
+	if n != 1 {
+		t.Fatal("expected the connection to be probed while watched")
+	}
+
+	stop2()
+	r.probes.mx.Lock()
+	n = len(r.probes.conns)
+	r.probes.mx.Unlock()
+	if n != 0 {
+		t.Fatal("expected probing to stop with the last watcher")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	probes := atomic.LoadInt32(&c.streams)
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&c.streams) != probes {
+		t.Fatal("expected the probe loop to exit")
+	}
+}
@@ -0,0 +1,99 @@
+package relay_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+)
+
+const (
+	keepaliveInterval = 50 * time.Millisecond
+	keepaliveFailures = 3
+)
+
+// keepaliveTopology sets up src -[relay]-> dst, and opens a relayed
+// connection between them.
+func keepaliveTopology(t *testing.T) (*relaytest.Network, *Conn, net.Conn) {
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	for _, node := range nw.Nodes {
+		node.Relay.SetKeepalive(keepaliveInterval, keepaliveFailures)
+	}
+
+	accept := nw.Nodes[2].Accept()
+	c, err := nw.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Reset() })
+
+	dc := accept()
+	t.Cleanup(func() { dc.Close() })
+
+	go io.Copy(dc, dc)
+
+	return nw, c, dc
+}
+
+func echo(t *testing.T, c net.Conn) {
+	t.Helper()
+
+	msg := []byte("still alive")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepaliveHealthy(t *testing.T) {
+	_, c, _ := keepaliveTopology(t)
+
+	time.Sleep(5 * keepaliveFailures * keepaliveInterval)
+	echo(t, c)
+}
+
+func TestKeepaliveRelayUnreachable(t *testing.T) {
+	nw, c, _ := keepaliveTopology(t)
+	echo(t, c)
+
+	// the relay silently stops answering
+	nw.Link(0, 1).SetLatency(time.Hour)
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.Read(make([]byte, 1))
+	if err != ErrRelayUnreachable {
+		t.Fatalf("expected ErrRelayUnreachable, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("took %s to notice the relay was unreachable", d)
+	}
+}
+
+func TestKeepaliveHopUnreachable(t *testing.T) {
+	nw, c, _ := keepaliveTopology(t)
+	echo(t, c)
+
+	// the destination silently stops answering; the relay resets the circuit
+	nw.Link(1, 2).SetLatency(time.Hour)
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected the circuit to be reset, got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for nw.Nodes[1].Relay.GetActiveHops() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the relay to drop the circuit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
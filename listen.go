@@ -26,17 +26,41 @@ func (l *RelayListener) Accept() (manet.Conn, error) {
 	for {
 		select {
 		case c := <-l.incoming:
+			// register resumable sessions before the source may try to
+			// resume them
+			var rc *ResumableConn
+			if c.token != nil {
+				rc = l.Relay().addSession(c.remote, c.token)
+			}
+
 			err := l.Relay().writeResponse(c.stream, pb.CircuitRelay_SUCCESS)
 			if err != nil {
 				log.Debugf("error writing relay response: %s", err.Error())
 				c.stream.Reset()
+				if rc != nil {
+					rc.fail(err)
+				}
 				continue
 			}
 
 			// TODO: Pretty print.
 			log.Infof("accepted relay connection: %q", c)
 
+			if rc != nil {
+				if err := writeFrame(c, frameHello, 0, nil); err != nil {
+					log.Debugf("error confirming resumable connection: %s", err.Error())
+					c.Reset()
+					rc.fail(err)
+					continue
+				}
+			}
+
 			c.tagHop()
+			c.startKeepalive()
+			if rc != nil {
+				rc.attach(c, nil)
+				return rc, nil
+			}
 			return c, nil
 		case <-l.ctx.Done():
 			return nil, l.ctx.Err()
@@ -45,10 +69,7 @@ func (l *RelayListener) Accept() (manet.Conn, error) {
 }
 
 func (l *RelayListener) Addr() net.Addr {
-	return &NetAddr{
-		Relay:  "any",
-		Remote: "any",
-	}
+	return &NetAddr{}
 }
 
 func (l *RelayListener) Multiaddr() ma.Multiaddr {
@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const netAddrNetwork = "libp2p-circuit-relay"
+
+func init() {
+	// Converters are registered by last protocol, and the addresses of
+	// relayed connections end with the /p2p component of the remote peer;
+	// /p2p addresses without a circuit fail to convert, as they do without
+	// a converter.
+	manet.RegisterFromNetAddr(parseNetAddr, netAddrNetwork)
+	manet.RegisterToNetAddr(convertMultiaddr, "p2p-circuit", "p2p")
+}
+
+// NetAddr is the net.Addr of a circuit address:
+// <RelayAddr>/p2p/<Relay>/p2p-circuit/p2p/<Remote>. All the fields are
+// optional; the address of relay listeners is the bare /p2p-circuit.
+type NetAddr struct {
+	// RelayAddr is the address the relay is reached at, which may itself go
+	// through other relays.
+	RelayAddr ma.Multiaddr
+	Relay     peer.ID
+	// Remote is the peer at the other end of the circuit.
+	Remote peer.ID
+}
+
+var _ net.Addr = (*NetAddr)(nil)
+
+// NewNetAddr returns the NetAddr of the circuit address a.
+func NewNetAddr(a ma.Multiaddr) (*NetAddr, error) {
+	parts := ma.Split(a)
+
+	circuit := -1
+	for i, p := range parts {
+		if p.Protocols()[0].Code == ma.P_CIRCUIT {
+			circuit = i
+		}
+	}
+	if circuit < 0 {
+		return nil, fmt.Errorf("%s is not a relay address", a)
+	}
+
+	n := new(NetAddr)
+
+	relay, remote := parts[:circuit], parts[circuit+1:]
+	if len(relay) > 0 {
+		id, err := p2pComponent(relay[len(relay)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay in %s: %s", a, err)
+		}
+		n.Relay = id
+		if len(relay) > 1 {
+			n.RelayAddr = ma.Join(relay[:len(relay)-1]...)
+		}
+	}
+
+	switch len(remote) {
+	case 0:
+	case 1:
+		id, err := p2pComponent(remote[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote peer in %s: %s", a, err)
+		}
+		n.Remote = id
+	default:
+		return nil, fmt.Errorf("unexpected components after the remote peer in %s", a)
+	}
+
+	return n, nil
+}
+
+// p2pComponent returns the peer ID of the /p2p component a.
+func p2pComponent(a ma.Multiaddr) (peer.ID, error) {
+	if a.Protocols()[0].Code != ma.P_P2P {
+		return "", fmt.Errorf("expected a /p2p component, got %s", a)
+	}
+	c, _ := ma.SplitFirst(a)
+	return peer.IDFromBytes(c.RawValue())
+}
+
+// p2pAddr returns the /p2p address of id.
+func p2pAddr(id peer.ID) (ma.Multiaddr, error) {
+	var buf [binary.MaxVarintLen64]byte
+	b := append(ma.CodeToVarint(ma.P_P2P), buf[:binary.PutUvarint(buf[:], uint64(len(id)))]...)
+	return ma.NewMultiaddrBytes(append(b, id...))
+}
+
+// circuitTo returns the /p2p/<id>/p2p-circuit address of relay id.
+func circuitTo(id peer.ID) (ma.Multiaddr, error) {
+	a, err := p2pAddr(id)
+	if err != nil {
+		return nil, err
+	}
+	return a.Encapsulate(circuitAddr), nil
+}
+
+func (n *NetAddr) Network() string {
+	return netAddrNetwork
+}
+
+func (n *NetAddr) String() string {
+	a, err := n.Multiaddr()
+	if err != nil {
+		return fmt.Sprintf("relay[%s-%s]", n.Remote, n.Relay)
+	}
+	return a.String()
+}
+
+// Multiaddr returns the circuit address of n.
+func (n *NetAddr) Multiaddr() (ma.Multiaddr, error) {
+	var parts []ma.Multiaddr
+	if n.RelayAddr != nil {
+		parts = append(parts, n.RelayAddr)
+	}
+	if n.Relay != "" {
+		a, err := p2pAddr(n.Relay)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, a)
+	}
+	parts = append(parts, circuitAddr)
+	if n.Remote != "" {
+		a, err := p2pAddr(n.Remote)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, a)
+	}
+	return ma.Join(parts...), nil
+}
+
+func parseNetAddr(a net.Addr) (ma.Multiaddr, error) {
+	n, ok := a.(*NetAddr)
+	if !ok {
+		return nil, fmt.Errorf("not a relay address: %s", a)
+	}
+	return n.Multiaddr()
+}
+
+func convertMultiaddr(a ma.Multiaddr) (net.Addr, error) {
+	return NewNetAddr(a)
+}
@@ -0,0 +1,98 @@
+package relay_test
+
+import (
+	"testing"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	testRelayID  = "QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"
+	testRemoteID = "QmSoLPppuBtQSGwKDZT2M73ULpjvfd3aZ6ha4oFGL1KrGM"
+)
+
+func TestNetAddrRoundtrip(t *testing.T) {
+	for _, s := range []string{
+		"/p2p-circuit",
+		"/p2p-circuit/p2p/" + testRemoteID,
+		"/p2p/" + testRelayID + "/p2p-circuit",
+		"/p2p/" + testRelayID + "/p2p-circuit/p2p/" + testRemoteID,
+		"/ip4/1.2.3.4/tcp/4001/p2p/" + testRelayID + "/p2p-circuit/p2p/" + testRemoteID,
+		"/ip4/1.2.3.4/tcp/4001/p2p/" + testRemoteID + "/p2p-circuit/p2p/" + testRelayID + "/p2p-circuit",
+	} {
+		a := ma.StringCast(s)
+
+		na, err := NewNetAddr(a)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if na.Network() != "libp2p-circuit-relay" {
+			t.Fatalf("%s: unexpected network %s", s, na.Network())
+		}
+		if na.String() != s {
+			t.Fatalf("%s: unexpected string %s", s, na.String())
+		}
+
+		back, err := manet.FromNetAddr(na)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if !back.Equal(a) {
+			t.Fatalf("%s: round-tripped to %s", s, back)
+		}
+	}
+}
+
+func TestNetAddrFields(t *testing.T) {
+	a := ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/" + testRelayID + "/p2p-circuit/p2p/" + testRemoteID)
+	n, err := NewNetAddr(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Relay.Pretty() != testRelayID {
+		t.Fatalf("unexpected relay %s", n.Relay)
+	}
+	if n.Remote.Pretty() != testRemoteID {
+		t.Fatalf("unexpected remote peer %s", n.Remote)
+	}
+	if !n.RelayAddr.Equal(ma.StringCast("/ip4/1.2.3.4/tcp/4001")) {
+		t.Fatalf("unexpected relay address %s", n.RelayAddr)
+	}
+}
+
+func TestNetAddrRegistration(t *testing.T) {
+	a := ma.StringCast("/p2p/" + testRelayID + "/p2p-circuit")
+	na, err := manet.ToNetAddr(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := na.(*NetAddr); !ok {
+		t.Fatalf("expected a relay address, got %T", na)
+	}
+
+	// so are circuit addresses ending with the remote peer
+	a = ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/" + testRelayID + "/p2p-circuit/p2p/" + testRemoteID)
+	na, err = manet.ToNetAddr(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := na.(*NetAddr); !ok || n.Remote.Pretty() != testRemoteID {
+		t.Fatalf("expected a relay address to %s, got %v", testRemoteID, na)
+	}
+}
+
+func TestNetAddrInvalid(t *testing.T) {
+	for _, s := range []string{
+		"/ip4/1.2.3.4/tcp/4001/p2p/" + testRelayID,
+		"/p2p/" + testRelayID,
+		"/ip4/1.2.3.4/tcp/4001/p2p-circuit",
+		"/p2p-circuit/ip4/1.2.3.4",
+	} {
+		if _, err := manet.ToNetAddr(ma.StringCast(s)); err == nil {
+			t.Fatalf("%s: expected conversion to fail", s)
+		}
+	}
+}
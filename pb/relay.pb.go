@@ -36,11 +36,16 @@ const (
 	CircuitRelay_HOP_CANT_OPEN_DST_STREAM   CircuitRelay_Status = 262
 	CircuitRelay_HOP_CANT_SPEAK_RELAY       CircuitRelay_Status = 270
 	CircuitRelay_HOP_CANT_RELAY_TO_SELF     CircuitRelay_Status = 280
+	CircuitRelay_HOP_CHAIN_DISABLED         CircuitRelay_Status = 290
+	CircuitRelay_HOP_CHAIN_TOO_LONG         CircuitRelay_Status = 291
+	CircuitRelay_HOP_CHAIN_LOOP             CircuitRelay_Status = 292
+	CircuitRelay_HOP_RECURSIVE_RELAY        CircuitRelay_Status = 293
 	CircuitRelay_STOP_SRC_ADDR_TOO_LONG     CircuitRelay_Status = 320
 	CircuitRelay_STOP_DST_ADDR_TOO_LONG     CircuitRelay_Status = 321
 	CircuitRelay_STOP_SRC_MULTIADDR_INVALID CircuitRelay_Status = 350
 	CircuitRelay_STOP_DST_MULTIADDR_INVALID CircuitRelay_Status = 351
 	CircuitRelay_STOP_RELAY_REFUSED         CircuitRelay_Status = 390
+	CircuitRelay_STOP_RESUME_REFUSED        CircuitRelay_Status = 391
 	CircuitRelay_MALFORMED_MESSAGE          CircuitRelay_Status = 400
 )
 
@@ -55,11 +60,16 @@ var CircuitRelay_Status_name = map[int32]string{
 	262: "HOP_CANT_OPEN_DST_STREAM",
 	270: "HOP_CANT_SPEAK_RELAY",
 	280: "HOP_CANT_RELAY_TO_SELF",
+	290: "HOP_CHAIN_DISABLED",
+	291: "HOP_CHAIN_TOO_LONG",
+	292: "HOP_CHAIN_LOOP",
+	293: "HOP_RECURSIVE_RELAY",
 	320: "STOP_SRC_ADDR_TOO_LONG",
 	321: "STOP_DST_ADDR_TOO_LONG",
 	350: "STOP_SRC_MULTIADDR_INVALID",
 	351: "STOP_DST_MULTIADDR_INVALID",
 	390: "STOP_RELAY_REFUSED",
+	391: "STOP_RESUME_REFUSED",
 	400: "MALFORMED_MESSAGE",
 }
 
@@ -74,11 +84,16 @@ var CircuitRelay_Status_value = map[string]int32{
 	"HOP_CANT_OPEN_DST_STREAM":   262,
 	"HOP_CANT_SPEAK_RELAY":       270,
 	"HOP_CANT_RELAY_TO_SELF":     280,
+	"HOP_CHAIN_DISABLED":         290,
+	"HOP_CHAIN_TOO_LONG":         291,
+	"HOP_CHAIN_LOOP":             292,
+	"HOP_RECURSIVE_RELAY":        293,
 	"STOP_SRC_ADDR_TOO_LONG":     320,
 	"STOP_DST_ADDR_TOO_LONG":     321,
 	"STOP_SRC_MULTIADDR_INVALID": 350,
 	"STOP_DST_MULTIADDR_INVALID": 351,
 	"STOP_RELAY_REFUSED":         390,
+	"STOP_RESUME_REFUSED":        391,
 	"MALFORMED_MESSAGE":          400,
 }
 
@@ -156,6 +171,11 @@ type CircuitRelay struct {
 	SrcPeer              *CircuitRelay_Peer   `protobuf:"bytes,2,opt,name=srcPeer" json:"srcPeer,omitempty"`
 	DstPeer              *CircuitRelay_Peer   `protobuf:"bytes,3,opt,name=dstPeer" json:"dstPeer,omitempty"`
 	Code                 *CircuitRelay_Status `protobuf:"varint,4,opt,name=code,enum=relay.pb.CircuitRelay_Status" json:"code,omitempty"`
+	RelayPath            []*CircuitRelay_Peer `protobuf:"bytes,5,rep,name=relayPath" json:"relayPath,omitempty"`
+	Visited              [][]byte             `protobuf:"bytes,6,rep,name=visited" json:"visited,omitempty"`
+	MaxHops              *uint32              `protobuf:"varint,7,opt,name=maxHops" json:"maxHops,omitempty"`
+	SessionToken         []byte               `protobuf:"bytes,8,opt,name=sessionToken" json:"sessionToken,omitempty"`
+	Resume               *bool                `protobuf:"varint,9,opt,name=resume" json:"resume,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
 	XXX_unrecognized     []byte               `json:"-"`
 	XXX_sizecache        int32                `json:"-"`
@@ -222,6 +242,41 @@ func (m *CircuitRelay) GetCode() CircuitRelay_Status {
 	return CircuitRelay_SUCCESS
 }
 
+func (m *CircuitRelay) GetRelayPath() []*CircuitRelay_Peer {
+	if m != nil {
+		return m.RelayPath
+	}
+	return nil
+}
+
+func (m *CircuitRelay) GetVisited() [][]byte {
+	if m != nil {
+		return m.Visited
+	}
+	return nil
+}
+
+func (m *CircuitRelay) GetMaxHops() uint32 {
+	if m != nil && m.MaxHops != nil {
+		return *m.MaxHops
+	}
+	return 0
+}
+
+func (m *CircuitRelay) GetSessionToken() []byte {
+	if m != nil {
+		return m.SessionToken
+	}
+	return nil
+}
+
+func (m *CircuitRelay) GetResume() bool {
+	if m != nil && m.Resume != nil {
+		return *m.Resume
+	}
+	return false
+}
+
 type CircuitRelay_Peer struct {
 	Id                   []byte   `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
 	Addrs                [][]byte `protobuf:"bytes,2,rep,name=addrs" json:"addrs,omitempty"`
@@ -287,37 +342,46 @@ func init() {
 func init() { proto.RegisterFile("relay.proto", fileDescriptor_9f69a7d5a802d584) }
 
 var fileDescriptor_9f69a7d5a802d584 = []byte{
-	// 473 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x92, 0x4f, 0x6f, 0xd3, 0x3e,
-	0x18, 0xc7, 0x65, 0x27, 0xbf, 0x76, 0x7a, 0x5a, 0x4d, 0xfe, 0x59, 0x63, 0x64, 0x9d, 0x56, 0xaa,
-	0x9e, 0x7a, 0x40, 0x45, 0x4c, 0xe2, 0x05, 0x98, 0xc4, 0xdd, 0x2a, 0xd2, 0x38, 0xb2, 0x5d, 0x24,
-	0x4e, 0x56, 0x69, 0x72, 0xa8, 0x84, 0xd4, 0x2a, 0xcd, 0x0e, 0xbd, 0xc3, 0xb8, 0x21, 0x8e, 0xbc,
-	0x1c, 0xe0, 0xc4, 0x91, 0x17, 0xc0, 0x3f, 0xf5, 0x65, 0xc0, 0x05, 0xd9, 0x5d, 0x33, 0x44, 0x37,
-	0x89, 0xa3, 0x9f, 0xef, 0xe7, 0xe3, 0x3c, 0xf9, 0x26, 0xd0, 0x28, 0xf2, 0x17, 0x93, 0x55, 0x7f,
-	0x51, 0xcc, 0xcb, 0x39, 0xdd, 0xbb, 0x3a, 0x3c, 0xef, 0xbe, 0xae, 0x41, 0x33, 0x9c, 0x15, 0xd3,
-	0x8b, 0x59, 0x29, 0xed, 0x8c, 0x3e, 0x00, 0xbf, 0x5c, 0x2d, 0xf2, 0x00, 0x75, 0x50, 0x6f, 0xff,
-	0xf4, 0xb8, 0xbf, 0x25, 0xfb, 0x7f, 0x52, 0x7d, 0xbd, 0x5a, 0xe4, 0xd2, 0x81, 0xf4, 0x11, 0xd4,
-	0x97, 0xc5, 0x34, 0xcd, 0xf3, 0x22, 0xc0, 0x1d, 0xd4, 0x6b, 0xdc, 0xea, 0x58, 0x44, 0x6e, 0x59,
-	0xab, 0x65, 0xcb, 0xd2, 0x69, 0xde, 0x3f, 0x68, 0x57, 0x2c, 0x7d, 0x08, 0xfe, 0x74, 0x9e, 0xe5,
-	0x81, 0xef, 0xd6, 0x3b, 0xb9, 0xc5, 0x51, 0xe5, 0xa4, 0xbc, 0x58, 0x4a, 0x87, 0xb6, 0xee, 0x83,
-	0xef, 0xd4, 0x7d, 0xc0, 0xb3, 0x2c, 0x40, 0x1d, 0xdc, 0x6b, 0x4a, 0x3c, 0xcb, 0xe8, 0x01, 0xfc,
-	0x37, 0xc9, 0xb2, 0x62, 0x19, 0xe0, 0x8e, 0xd7, 0x6b, 0xca, 0xcd, 0xa1, 0xfb, 0xd1, 0x83, 0xda,
-	0x46, 0xa7, 0x0d, 0xa8, 0xab, 0x71, 0x18, 0x72, 0xa5, 0x48, 0x46, 0x5b, 0x70, 0xe7, 0x5c, 0xa4,
-	0x46, 0xc9, 0xd0, 0xb0, 0x28, 0x92, 0x46, 0x0b, 0x61, 0x62, 0x91, 0x9c, 0x91, 0x2f, 0x68, 0x9b,
-	0x45, 0x4a, 0xff, 0x95, 0x7d, 0x45, 0xb4, 0x0d, 0x47, 0x5b, 0x6f, 0x34, 0x8e, 0xf5, 0xd0, 0x01,
-	0xc3, 0xe4, 0x29, 0x8b, 0x87, 0x11, 0xf9, 0x59, 0xe5, 0xd6, 0xdd, 0xcd, 0x7f, 0x21, 0x7a, 0x17,
-	0xa8, 0xcd, 0x13, 0x61, 0x42, 0x91, 0x24, 0x46, 0x0b, 0x8b, 0x92, 0x97, 0x98, 0x1e, 0xc2, 0xff,
-	0x36, 0x08, 0x59, 0xa2, 0x4d, 0x34, 0x64, 0xb1, 0x9b, 0xbf, 0xc2, 0xf4, 0x04, 0x82, 0x6a, 0x2e,
-	0x52, 0x9e, 0xb8, 0xab, 0x95, 0x96, 0x9c, 0x8d, 0xc8, 0x25, 0xa6, 0x47, 0x70, 0x50, 0xc5, 0x2a,
-	0xe5, 0xec, 0x89, 0x91, 0x3c, 0x66, 0xcf, 0xc8, 0x1b, 0x4c, 0x8f, 0xe1, 0xb0, 0x8a, 0xdc, 0xd0,
-	0x3e, 0x4d, 0xf1, 0x78, 0x40, 0xde, 0xb9, 0x50, 0xe9, 0x1b, 0x0b, 0x78, 0x7f, 0x1d, 0xee, 0x36,
-	0xf0, 0x01, 0xd3, 0x7b, 0xd0, 0xaa, 0xcc, 0xdd, 0x57, 0xfc, 0x76, 0x0d, 0xdc, 0xdc, 0xc1, 0x77,
-	0x6c, 0x3b, 0x70, 0xc0, 0x66, 0x29, 0xc9, 0x07, 0x63, 0xc5, 0x23, 0x72, 0xe9, 0xd9, 0x0e, 0x46,
-	0x2c, 0x1e, 0x08, 0x39, 0xe2, 0x91, 0x19, 0x71, 0xa5, 0xd8, 0x19, 0x27, 0x6f, 0xbd, 0xee, 0x29,
-	0xf8, 0xf6, 0x0f, 0xa5, 0x75, 0xf0, 0xce, 0x45, 0x4a, 0x10, 0xdd, 0x03, 0xdf, 0xde, 0x40, 0x30,
-	0x05, 0xa8, 0x29, 0xcd, 0xf4, 0x58, 0x11, 0xcf, 0x7e, 0xe0, 0x90, 0x25, 0xc6, 0x22, 0xfe, 0xe3,
-	0xe6, 0xa7, 0x75, 0x1b, 0x7d, 0x5e, 0xb7, 0xd1, 0x8f, 0x75, 0x1b, 0xfd, 0x0e, 0x00, 0x00, 0xff,
-	0xff, 0x6b, 0x22, 0x33, 0xbb, 0x2f, 0x03, 0x00, 0x00,
+	// 616 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x93, 0xcd, 0x6e, 0xd3, 0x4a,
+	0x14, 0xc7, 0x35, 0x63, 0x37, 0x49, 0x4f, 0x73, 0xab, 0xb9, 0xd3, 0xde, 0x5e, 0xb7, 0x55, 0x83,
+	0x95, 0x55, 0x16, 0x28, 0x88, 0x4a, 0x2c, 0x58, 0xba, 0xf6, 0xb4, 0x89, 0x70, 0x6c, 0x6b, 0xc6,
+	0xa9, 0xc4, 0xca, 0x0a, 0xb5, 0x25, 0x2c, 0x68, 0x13, 0xd9, 0x2e, 0xa2, 0x7b, 0x28, 0x3b, 0xc4,
+	0x92, 0x35, 0x1f, 0x4b, 0x1e, 0x01, 0x09, 0x76, 0x2c, 0x79, 0x00, 0xbe, 0xd4, 0xc7, 0x80, 0x0d,
+	0x9a, 0x69, 0xec, 0x40, 0x3f, 0x04, 0xcb, 0x73, 0x7e, 0xbf, 0xbf, 0xe7, 0x9c, 0xa3, 0x04, 0x16,
+	0xb2, 0xe4, 0xfe, 0xe8, 0xa8, 0x3b, 0xc9, 0xc6, 0xc5, 0x98, 0x36, 0xa6, 0xc5, 0x9d, 0xf6, 0x9b,
+	0x06, 0x34, 0xed, 0x34, 0xdb, 0x3b, 0x4c, 0x0b, 0x2e, 0x7b, 0xf4, 0x1a, 0xe8, 0xc5, 0xd1, 0x24,
+	0x31, 0x90, 0x89, 0x3a, 0x8b, 0x9b, 0xeb, 0xdd, 0xd2, 0xec, 0xfe, 0x6a, 0x75, 0xc3, 0xa3, 0x49,
+	0xc2, 0x95, 0x48, 0x6f, 0x40, 0x3d, 0xcf, 0xf6, 0x82, 0x24, 0xc9, 0x0c, 0x6c, 0xa2, 0xce, 0xc2,
+	0xa5, 0x19, 0xa9, 0xf0, 0xd2, 0x95, 0xb1, 0x38, 0x2f, 0x54, 0x4c, 0xfb, 0x8b, 0xd8, 0xd4, 0xa5,
+	0xd7, 0x41, 0xdf, 0x1b, 0xc7, 0x89, 0xa1, 0xab, 0xf1, 0x36, 0x2e, 0xc9, 0x88, 0x62, 0x54, 0x1c,
+	0xe6, 0x5c, 0xa9, 0xf4, 0x26, 0xcc, 0x2b, 0x2b, 0x18, 0x15, 0x77, 0x8d, 0x39, 0x53, 0xfb, 0xd3,
+	0x5b, 0x33, 0x9b, 0x1a, 0x50, 0x7f, 0x90, 0xe6, 0x69, 0x91, 0xc4, 0x46, 0xcd, 0xd4, 0x3a, 0x4d,
+	0x5e, 0x96, 0x92, 0xec, 0x8f, 0x1e, 0xf6, 0xc6, 0x93, 0xdc, 0xa8, 0x9b, 0xa8, 0xf3, 0x0f, 0x2f,
+	0x4b, 0xda, 0x86, 0x66, 0x9e, 0xe4, 0x79, 0x3a, 0x3e, 0x08, 0xc7, 0xf7, 0x92, 0x03, 0xa3, 0x61,
+	0xa2, 0x4e, 0x93, 0xff, 0xd6, 0xa3, 0x2b, 0x50, 0xcb, 0x92, 0xfc, 0x70, 0x3f, 0x31, 0xe6, 0x4d,
+	0xd4, 0x69, 0xf0, 0x69, 0xb5, 0x76, 0x15, 0x74, 0xb5, 0xe5, 0x22, 0xe0, 0x34, 0x36, 0x90, 0x89,
+	0x3b, 0x4d, 0x8e, 0xd3, 0x98, 0x2e, 0xc3, 0xdc, 0x28, 0x8e, 0xb3, 0xdc, 0xc0, 0x6a, 0x8a, 0xd3,
+	0xa2, 0xfd, 0x56, 0x87, 0xda, 0xe9, 0xa6, 0x74, 0x01, 0xea, 0x62, 0x68, 0xdb, 0x4c, 0x08, 0x12,
+	0xd3, 0x35, 0xf8, 0xaf, 0xe7, 0x07, 0x91, 0xe0, 0x76, 0x64, 0x39, 0x0e, 0x8f, 0x42, 0xdf, 0x8f,
+	0x5c, 0xdf, 0xdb, 0x21, 0x9f, 0x50, 0xc9, 0x1c, 0x11, 0x9e, 0x61, 0x9f, 0x11, 0x6d, 0xc1, 0x6a,
+	0x99, 0x1b, 0x0c, 0xdd, 0xb0, 0xaf, 0x84, 0xbe, 0xb7, 0x6b, 0xb9, 0x7d, 0x87, 0x7c, 0xaf, 0xb8,
+	0xcc, 0x9e, 0xe7, 0x3f, 0x10, 0xfd, 0x1f, 0xa8, 0xe4, 0x9e, 0x1f, 0xd9, 0xbe, 0xe7, 0x45, 0xa1,
+	0x2f, 0x55, 0xf2, 0x08, 0xd3, 0x15, 0xf8, 0x57, 0x02, 0xdb, 0xf2, 0xc2, 0xc8, 0xe9, 0x5b, 0xae,
+	0xea, 0x3f, 0xc6, 0x74, 0x03, 0x8c, 0xaa, 0xef, 0x07, 0xcc, 0x53, 0x9f, 0x16, 0x21, 0x67, 0xd6,
+	0x80, 0x1c, 0x63, 0xba, 0x0a, 0xcb, 0x15, 0x16, 0x01, 0xb3, 0x6e, 0x45, 0x9c, 0xb9, 0xd6, 0x6d,
+	0xf2, 0x14, 0xd3, 0x75, 0x58, 0xa9, 0x90, 0x6a, 0xca, 0xd7, 0x04, 0x73, 0xb7, 0xc9, 0x73, 0x5c,
+	0xce, 0x61, 0xf7, 0xac, 0xbe, 0x17, 0x39, 0x7d, 0x61, 0x6d, 0xb9, 0xcc, 0x21, 0x2f, 0xce, 0x80,
+	0x6a, 0xf3, 0x97, 0x98, 0x2e, 0xc1, 0xe2, 0x0c, 0xb8, 0xbe, 0x1f, 0x90, 0x57, 0x98, 0x1a, 0xb0,
+	0x24, 0x9b, 0x9c, 0xd9, 0x43, 0x2e, 0xfa, 0xbb, 0x6c, 0xfa, 0xfa, 0x6b, 0xf5, 0xba, 0x08, 0x2f,
+	0xbc, 0xf0, 0xbb, 0x19, 0x3c, 0x7f, 0xe2, 0xf7, 0x98, 0x5e, 0x81, 0xb5, 0x2a, 0x79, 0xfe, 0x86,
+	0x5f, 0x66, 0xc2, 0xc5, 0x47, 0xfe, 0xaa, 0x76, 0x50, 0xc2, 0xe9, 0xd6, 0x9c, 0x6d, 0x0f, 0x05,
+	0x73, 0xc8, 0xb1, 0x26, 0xc7, 0x9d, 0x02, 0x31, 0x1c, 0xb0, 0x8a, 0x3c, 0xd1, 0xe4, 0xf9, 0x07,
+	0x96, 0xbb, 0xed, 0xf3, 0x01, 0x73, 0xa2, 0x01, 0x13, 0xc2, 0xda, 0x61, 0xe4, 0x99, 0xd6, 0xde,
+	0x04, 0x5d, 0xfe, 0x8f, 0x69, 0x1d, 0xb4, 0x9e, 0x1f, 0x10, 0x44, 0x1b, 0xa0, 0xcb, 0x4f, 0x10,
+	0x4c, 0x01, 0x6a, 0x22, 0xb4, 0xc2, 0xa1, 0x20, 0x9a, 0xfc, 0x6d, 0xd9, 0x96, 0x17, 0x49, 0x45,
+	0xdf, 0x6a, 0x7e, 0x38, 0x69, 0xa1, 0x8f, 0x27, 0x2d, 0xf4, 0xed, 0xa4, 0x85, 0x7e, 0x0e, 0x00,
+	0x73, 0xf5, 0x94, 0x6d, 0x55, 0x04, 0x00, 0x00,
 }
 
 func (m *CircuitRelay) Marshal() (dAtA []byte, err error) {
@@ -344,6 +408,51 @@ func (m *CircuitRelay) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Resume != nil {
+		i--
+		if *m.Resume {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x48
+	}
+	if m.SessionToken != nil {
+		i -= len(m.SessionToken)
+		copy(dAtA[i:], m.SessionToken)
+		i = encodeVarintRelay(dAtA, i, uint64(len(m.SessionToken)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if m.MaxHops != nil {
+		i = encodeVarintRelay(dAtA, i, uint64(*m.MaxHops))
+		i--
+		dAtA[i] = 0x38
+	}
+	if len(m.Visited) > 0 {
+		for iNdEx := len(m.Visited) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Visited[iNdEx])
+			copy(dAtA[i:], m.Visited[iNdEx])
+			i = encodeVarintRelay(dAtA, i, uint64(len(m.Visited[iNdEx])))
+			i--
+			dAtA[i] = 0x32
+		}
+	}
+	if len(m.RelayPath) > 0 {
+		for iNdEx := len(m.RelayPath) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RelayPath[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRelay(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x2a
+		}
+	}
 	if m.Code != nil {
 		i = encodeVarintRelay(dAtA, i, uint64(*m.Code))
 		i--
@@ -457,6 +566,28 @@ func (m *CircuitRelay) Size() (n int) {
 	if m.Code != nil {
 		n += 1 + sovRelay(uint64(*m.Code))
 	}
+	if len(m.RelayPath) > 0 {
+		for _, e := range m.RelayPath {
+			l = e.Size()
+			n += 1 + l + sovRelay(uint64(l))
+		}
+	}
+	if len(m.Visited) > 0 {
+		for _, b := range m.Visited {
+			l = len(b)
+			n += 1 + l + sovRelay(uint64(l))
+		}
+	}
+	if m.MaxHops != nil {
+		n += 1 + sovRelay(uint64(*m.MaxHops))
+	}
+	if m.SessionToken != nil {
+		l = len(m.SessionToken)
+		n += 1 + l + sovRelay(uint64(l))
+	}
+	if m.Resume != nil {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -632,6 +763,147 @@ func (m *CircuitRelay) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Code = &v
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayPath", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRelay
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRelay
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRelay
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RelayPath = append(m.RelayPath, &CircuitRelay_Peer{})
+			if err := m.RelayPath[len(m.RelayPath)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Visited", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRelay
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRelay
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRelay
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Visited = append(m.Visited, make([]byte, postIndex-iNdEx))
+			copy(m.Visited[len(m.Visited)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxHops", wireType)
+			}
+			var v uint32
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRelay
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.MaxHops = &v
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SessionToken", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRelay
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRelay
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRelay
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SessionToken = append(m.SessionToken[:0], dAtA[iNdEx:postIndex]...)
+			if m.SessionToken == nil {
+				m.SessionToken = []byte{}
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Resume", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRelay
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			b := bool(v != 0)
+			m.Resume = &b
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRelay(dAtA[iNdEx:])
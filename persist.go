@@ -0,0 +1,341 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// MaxPreferredRelays is the number of relays, most recently used first, that
+// PreferredRelays remembers.
+var MaxPreferredRelays = 16
+
+// Datastore keys of the persisted state, each followed by the peer ID or the
+// IP address it is about.
+var (
+	dsBans      = datastore.NewKey("/relay/bans")
+	dsPeerBans  = dsBans.ChildString("peer")
+	dsIPBans    = dsBans.ChildString("ip")
+	dsRelays    = datastore.NewKey("/relay/relays")
+	dsReserved  = datastore.NewKey("/relay/reserved")
+	dsProtected = datastore.NewKey("/relay/protected")
+)
+
+type banRecord struct {
+	Expires time.Time
+}
+
+type relayRecord struct {
+	Addrs    []string
+	LastUsed time.Time
+}
+
+// store persists relay state to a datastore. Writes are best effort: errors
+// are logged, and the in-memory state stays authoritative. A nil store
+// persists nothing.
+type store struct {
+	ctx context.Context
+	ds  datastore.Datastore
+
+	// batches are committed in the order of their sequence numbers
+	mx   sync.Mutex
+	cond *sync.Cond
+	// the sequence number of the next batch, and of the next to commit
+	seq, committed uint64
+}
+
+func newStore(ctx context.Context, ds datastore.Datastore) *store {
+	s := &store{ctx: ctx, ds: ds}
+	s.cond = sync.NewCond(&s.mx)
+	return s
+}
+
+func (s *store) put(k datastore.Key, v interface{}) {
+	if s == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("error encoding %s: %s", k, err)
+		return
+	}
+	if err := s.ds.Put(s.ctx, k, b); err != nil {
+		log.Warnf("error persisting %s: %s", k, err)
+	}
+}
+
+func (s *store) delete(k datastore.Key) {
+	if s == nil {
+		return
+	}
+	if err := s.ds.Delete(s.ctx, k); err != nil {
+		log.Warnf("error deleting %s: %s", k, err)
+	}
+}
+
+// deleteAll deletes all the keys under prefix.
+func (s *store) deleteAll(prefix datastore.Key) {
+	if s == nil {
+		return
+	}
+	var keys []datastore.Key
+	err := s.load(prefix, func(k datastore.Key, _ []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		log.Warnf("error listing %s: %s", prefix, err)
+	}
+	for _, k := range keys {
+		s.delete(k)
+	}
+}
+
+// batch collects the writes of changes made to the state under a lock, so
+// that they are persisted once it is released rather than holding it during
+// disk I/O. Its first write takes a sequence number, under the lock, and
+// batches are committed in that order, so that a write never overwrites a
+// later one to the same key. Writes to a nil store are dropped.
+type batch struct {
+	s      *store
+	seq    uint64
+	writes []func()
+}
+
+func (b *batch) add(s *store, f func()) {
+	if s == nil {
+		return
+	}
+	if b.s == nil {
+		s.mx.Lock()
+		b.s, b.seq = s, s.seq
+		s.seq++
+		s.mx.Unlock()
+	}
+	b.writes = append(b.writes, f)
+}
+
+func (b *batch) put(s *store, k datastore.Key, v interface{}) {
+	b.add(s, func() { s.put(k, v) })
+}
+
+func (b *batch) delete(s *store, k datastore.Key) {
+	b.add(s, func() { s.delete(k) })
+}
+
+func (b *batch) deleteAll(s *store, prefix datastore.Key) {
+	b.add(s, func() { s.deleteAll(prefix) })
+}
+
+// commit performs the writes, in order, once the batches before it are
+// committed.
+func (b *batch) commit() {
+	s := b.s
+	if s == nil {
+		return
+	}
+
+	s.mx.Lock()
+	for s.committed != b.seq {
+		s.cond.Wait()
+	}
+	s.mx.Unlock()
+
+	for _, f := range b.writes {
+		f()
+	}
+
+	s.mx.Lock()
+	s.committed++
+	s.cond.Broadcast()
+	s.mx.Unlock()
+
+	*b = batch{}
+}
+
+// commitAsync commits the batch in the background, for writes the caller
+// doesn't need to wait for.
+func (b *batch) commitAsync() {
+	if b.s == nil {
+		return
+	}
+	c := *b
+	*b = batch{}
+	go c.commit()
+}
+
+// load calls f with the keys and values under prefix.
+func (s *store) load(prefix datastore.Key, f func(k datastore.Key, v []byte) error) error {
+	res, err := s.ds.Query(s.ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		if err := f(datastore.NewKey(e.Key), e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPeers calls f with the peer IDs under prefix and their values, skipping
+// and deleting unparseable records.
+func (s *store) loadPeers(prefix datastore.Key, f func(p peer.ID, v []byte) error) error {
+	var invalid []datastore.Key
+	err := s.load(prefix, func(k datastore.Key, v []byte) error {
+		p, err := peer.Decode(k.Name())
+		if err != nil {
+			invalid = append(invalid, k)
+			return nil
+		}
+		return f(p, v)
+	})
+	for _, k := range invalid {
+		log.Warnf("dropping invalid relay state record %s", k)
+		s.delete(k)
+	}
+	return err
+}
+
+func peerKey(prefix datastore.Key, p peer.ID) datastore.Key {
+	return prefix.ChildString(peer.Encode(p))
+}
+
+func ipKey(ip net.IP) datastore.Key {
+	return dsIPBans.ChildString(ip.String())
+}
+
+// SetDatastore makes the relay persist its bans, preferred relays, reserved
+// clients and protected relays to ds, and restores those persisted there
+// before, typically by a previous run of the relay. It should be called
+// before the relay starts serving requests and dialing relays.
+func (r *Relay) SetDatastore(ds datastore.Datastore) error {
+	s := newStore(r.ctx, ds)
+
+	if err := r.scores.restore(s); err != nil {
+		return err
+	}
+	if err := r.tags.restore(s); err != nil {
+		return err
+	}
+
+	var protected []peer.ID
+	err := s.loadPeers(dsProtected, func(p peer.ID, _ []byte) error {
+		protected = append(protected, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range protected {
+		r.host.ConnManager().Protect(p, reservationTag)
+	}
+
+	preferred := make(map[peer.ID]time.Time)
+	err = s.loadPeers(dsRelays, func(p peer.ID, v []byte) error {
+		var rec relayRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			log.Warnf("dropping invalid preferred relay record of %s: %s", p, err)
+			return nil
+		}
+		var addrs []ma.Multiaddr
+		for _, addr := range rec.Addrs {
+			if a, err := ma.NewMultiaddr(addr); err == nil {
+				addrs = append(addrs, a)
+			}
+		}
+		r.host.Peerstore().AddAddrs(p, addrs, peerstore.RecentlyConnectedAddrTTL)
+		preferred[p] = rec.LastUsed
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var b batch
+	defer b.commit()
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.store = s
+	for p, t := range preferred {
+		r.preferred[p] = t
+	}
+	r.prunePreferred(&b)
+	return nil
+}
+
+// usedRelay records relay p as preferred after it relayed a connection.
+func (r *Relay) usedRelay(p peer.ID) {
+	var rec relayRecord
+	for _, a := range r.host.Peerstore().Addrs(p) {
+		rec.Addrs = append(rec.Addrs, a.String())
+	}
+	rec.LastUsed = time.Now()
+
+	// dials don't wait for the record to be persisted
+	var b batch
+	defer b.commitAsync()
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.preferred[p] = rec.LastUsed
+	b.put(r.store, peerKey(dsRelays, p), rec)
+	r.prunePreferred(&b)
+}
+
+// prunePreferred forgets the least recently used preferred relays beyond
+// MaxPreferredRelays, adding the deletions to b; r.mx must be held.
+func (r *Relay) prunePreferred(b *batch) {
+	ids := r.preferredRelays()
+	if len(ids) <= MaxPreferredRelays {
+		return
+	}
+	for _, p := range ids[MaxPreferredRelays:] {
+		delete(r.preferred, p)
+		b.delete(r.store, peerKey(dsRelays, p))
+	}
+}
+
+// preferredRelays returns the preferred relays, most recently used first;
+// r.mx must be held.
+func (r *Relay) preferredRelays() []peer.ID {
+	ids := make([]peer.ID, 0, len(r.preferred))
+	for p := range r.preferred {
+		ids = append(ids, p)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return r.preferred[ids[i]].After(r.preferred[ids[j]])
+	})
+	return ids
+}
+
+// PreferredRelays returns the relays that relayed connections dialed by the
+// local peer, most recently used first.
+func (r *Relay) PreferredRelays() []peer.AddrInfo {
+	r.mx.Lock()
+	ids := r.preferredRelays()
+	r.mx.Unlock()
+
+	relays := make([]peer.AddrInfo, 0, len(ids))
+	for _, p := range ids {
+		relays = append(relays, r.host.Peerstore().PeerInfo(p))
+	}
+	return relays
+}
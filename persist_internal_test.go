@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+)
+
+func newBlockingDatastore() *blockingDatastore {
+	return &blockingDatastore{
+		Datastore: dssync.MutexWrap(datastore.NewMapDatastore()),
+		writing:   make(chan struct{}),
+		unblock:   make(chan struct{}),
+	}
+}
+
+// blockingDatastore blocks its writes until unblocked.
+type blockingDatastore struct {
+	datastore.Datastore
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (ds *blockingDatastore) Put(ctx context.Context, k datastore.Key, v []byte) error {
+	ds.writing <- struct{}{}
+	<-ds.unblock
+	return ds.Datastore.Put(ctx, k, v)
+}
+
+func TestScoreboardWritesOutsideLock(t *testing.T) {
+	ds := newBlockingDatastore()
+	sb := newScoreboard()
+	if err := sb.restore(newStore(context.Background(), ds)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sb.penalize("banned", nil, BanThreshold+1)
+	}()
+	<-ds.writing
+
+	// the scoreboard is usable while the ban is being persisted
+	checked := make(chan bool)
+	go func() { checked <- sb.banned("banned", nil) }()
+	select {
+	case banned := <-checked:
+		if !banned {
+			t.Fatal("expected the peer to be banned")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("scoreboard blocked by a datastore write")
+	}
+
+	close(ds.unblock)
+	<-done
+	if ok, err := ds.Has(context.Background(), peerKey(dsPeerBans, "banned")); err != nil || !ok {
+		t.Fatalf("expected the ban to be persisted, got %v, %v", ok, err)
+	}
+}
+
+func TestScoreboardWritesInOrder(t *testing.T) {
+	ds := newBlockingDatastore()
+	sb := newScoreboard()
+	if err := sb.restore(newStore(context.Background(), ds)); err != nil {
+		t.Fatal(err)
+	}
+
+	banned := make(chan struct{})
+	go func() {
+		defer close(banned)
+		sb.penalize("banned", nil, BanThreshold+1)
+	}()
+	<-ds.writing
+
+	// the unban is made while the ban is being persisted
+	unbanned := make(chan struct{})
+	go func() {
+		defer close(unbanned)
+		sb.unban("banned")
+	}()
+	for sb.banned("banned", nil) {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(ds.unblock)
+	<-banned
+	<-unbanned
+	if ok, err := ds.Has(context.Background(), peerKey(dsPeerBans, "banned")); err != nil || ok {
+		t.Fatalf("expected the ban to be deleted after being persisted, got %v, %v", ok, err)
+	}
+}
+
+func TestUsedRelayDoesntWaitForDatastore(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRelay(&fuzzHost{ps: ps}, nil)
+	defer r.ctxCancel()
+
+	ds := newBlockingDatastore()
+	r.store = newStore(context.Background(), ds)
+
+	used := make(chan struct{})
+	go func() {
+		defer close(used)
+		r.usedRelay("relay")
+	}()
+	select {
+	case <-used:
+	case <-time.After(time.Second):
+		t.Fatal("dial blocked by a datastore write")
+	}
+
+	<-ds.writing
+	close(ds.unblock)
+	for {
+		ok, err := ds.Has(context.Background(), peerKey(dsRelays, "relay"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
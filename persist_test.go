@@ -0,0 +1,146 @@
+package relay_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+// testPersist runs a relay and a client with the datastores returned by open,
+// restarts them, and checks that their state was restored. restart is called
+// in between.
+func testPersist(t *testing.T, open func(node int) datastore.Datastore, restart func()) {
+	defer func(threshold float64) { IPBanThreshold = threshold }(IPBanThreshold)
+	IPBanThreshold = BanThreshold
+
+	setDatastores := func(nw *relaytest.Network) {
+		for _, i := range []int{0, 1} {
+			if err := nw.Nodes[i].Relay.SetDatastore(open(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	setDatastores(nw)
+	src, r, dst := nw.Nodes[0], nw.Nodes[1], nw.Nodes[2]
+	rid := r.Host.ID()
+
+	accept := dst.Accept()
+	c, err := nw.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	accept().Close()
+	src.Relay.ProtectRelay(rid)
+
+	// get the client and its IP address banned
+	for i := 0; i < 11; i++ {
+		roundtrip(t, src.Host, rid, hopMsg(src.Host.ID(), rid))
+	}
+	if bans := r.Relay.Bans(); len(bans) != 2 {
+		t.Fatalf("expected the client and its IP address to be banned, got %v", bans)
+	}
+	r.Relay.ReserveClient(dst.Host.ID())
+
+	restart()
+
+	// the nodes come back up with the same identities
+	nw = relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	src, r, dst = nw.Nodes[0], nw.Nodes[1], nw.Nodes[2]
+	r.Relay.SetTagStrategy(func(p peer.ID, info TagInfo) int {
+		if info.Reserved {
+			return 1000
+		}
+		return info.Circuits
+	})
+	setDatastores(nw)
+
+	bans := r.Relay.Bans()
+	if len(bans) != 2 {
+		t.Fatalf("expected the bans to be restored, got %v", bans)
+	}
+	for _, ban := range bans {
+		if ban.IP == nil && ban.Peer != src.Host.ID() {
+			t.Fatalf("unexpected ban %v", ban)
+		}
+	}
+
+	if w, _ := r.ConnMgr.Tag(dst.Host.ID(), hopTag); w != 1000 {
+		t.Fatalf("expected the reserved client to be restored, got a weight of %d", w)
+	}
+
+	relays := src.Relay.PreferredRelays()
+	if len(relays) != 1 || relays[0].ID != rid || len(relays[0].Addrs) == 0 {
+		t.Fatalf("expected the relay to be preferred, got %v", relays)
+	}
+	if !src.ConnMgr.IsProtected(rid, "") {
+		t.Fatal("expected the relay to be protected")
+	}
+
+	// changes are persisted too
+	r.Relay.ClearBans()
+	r.Relay.UnreserveClient(dst.Host.ID())
+	src.Relay.UnprotectRelay(rid)
+	for _, prefix := range []string{"/relay/bans", "/relay/reserved", "/relay/protected"} {
+		for _, i := range []int{0, 1} {
+			res, err := open(i).Query(context.Background(), query.Query{Prefix: prefix, KeysOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := res.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected no records under %s, got %v", prefix, entries)
+			}
+		}
+	}
+}
+
+func TestPersistMemory(t *testing.T) {
+	stores := []datastore.Datastore{
+		dssync.MutexWrap(datastore.NewMapDatastore()),
+		dssync.MutexWrap(datastore.NewMapDatastore()),
+	}
+	testPersist(t, func(i int) datastore.Datastore { return stores[i] }, func() {})
+}
+
+func TestPersistLevelDB(t *testing.T) {
+	dir := t.TempDir()
+	stores := make([]*leveldb.Datastore, 2)
+	open := func(i int) datastore.Datastore {
+		if stores[i] == nil {
+			ds, err := leveldb.NewDatastore(filepath.Join(dir, fmt.Sprint(i)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores[i] = ds
+		}
+		return stores[i]
+	}
+	closeAll := func() {
+		for i, ds := range stores {
+			if ds != nil {
+				ds.Close()
+				stores[i] = nil
+			}
+		}
+	}
+	t.Cleanup(closeAll)
+
+	testPersist(t, open, closeAll)
+}
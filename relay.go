@@ -3,23 +3,22 @@ package relay
 import (
 	"context"
 	"fmt"
-	"io"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	pb "github.com/libp2p/go-libp2p-circuit/pb"
 
+	"github.com/libp2p/go-libp2p-core/discovery"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/transport"
 
-	pool "github.com/libp2p/go-buffer-pool"
-
 	logging "github.com/ipfs/go-log/v2"
 
+	"github.com/gogo/protobuf/proto"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -37,6 +36,11 @@ var (
 	HopStreamBufferSize = 4096
 	HopStreamLimit      = 1 << 19 // 512K hops for 1M goroutines
 
+	// MaxPeerAddrs and MaxAddrLength bound the number and byte length of
+	// the addresses a peer may advertise in a relay handshake.
+	MaxPeerAddrs  = 64
+	MaxAddrLength = 512
+
 	streamTimeout = 1 * time.Minute
 )
 
@@ -48,8 +52,15 @@ type Relay struct {
 	ctxCancel context.CancelFunc
 	self      peer.ID
 
-	active bool
-	hop    bool
+	active    bool
+	hop       bool
+	chaining  bool
+	resumable bool
+
+	// keepalive probing of circuit connections; disabled if kaInterval is 0
+	kaInterval time.Duration
+	kaFailures int
+	probes     *prober
 
 	incoming chan *Conn
 
@@ -57,9 +68,42 @@ type Relay struct {
 	streamCount  int32
 	liveHopCount int32
 
-	// per peer hop counters
-	mx       sync.Mutex
-	hopCount map[peer.ID]int
+	mx sync.Mutex
+
+	// destination dial backoff for active relays
+	backoff *dialBackoff
+
+	// filter for destination addresses dialed by active relays
+	dstFilter *AddrFilter
+	// filter for source addresses advertised by relays in stop requests
+	srcFilter *AddrFilter
+
+	// penalty scores and bans for hop relays
+	scores *scoreboard
+
+	// connection manager tags of the peers at the ends of relayed circuits,
+	// and of the relays of relayed connections
+	tags *tagger
+
+	// bandwidth scheduler for relayed circuits
+	sched *scheduler
+
+	// resumable sessions accepted by the relay, protected by mx
+	sessions map[sessionKey]*ResumableConn
+
+	// persisted state, protected by mx
+	store     *store
+	preferred map[peer.ID]time.Time
+
+	// relays that recently confirmed they can hop, by time of confirmation,
+	// protected by mx
+	verifiedRelays map[peer.ID]time.Time
+
+	// advertisement of hop relays, protected by mx; readvertise wakes the
+	// advertising loop up when the advertiser changes
+	advertiser  discovery.Advertiser
+	advertising bool
+	readvertise chan struct{}
 }
 
 // RelayOpts are options for configuring the relay transport.
@@ -82,8 +126,20 @@ var (
 	// _active_ relays (i.e., will actively dial the target peer).
 	//
 	// This option may be re-enabled in the future but for now you shouldn't
-	// use it.
+	// use it: hop relays advertise themselves through the discovery
+	// advertiser set with Relay.SetAdvertiser, and are discovered with a
+	// RelayFinder instead.
 	OptDiscovery = RelayOpt(2)
+	// OptChaining enables circuits through a chain of relays, of up to
+	// MaxRelayHops relays: dialing them, and relaying them along with
+	// OptHop. Without it, hop requests that are part of a chain are refused,
+	// and so are hop requests that would be relayed from or to a relayed
+	// connection.
+	OptChaining = RelayOpt(3)
+	// OptResumable enables resumable circuits: dialing them with
+	// DialResumable, and accepting them. Without it, resumable circuits are
+	// refused.
+	OptResumable = RelayOpt(4)
 )
 
 type RelayError struct {
@@ -96,14 +152,7 @@ func (e RelayError) Error() string {
 
 // NewRelay constructs a new relay.
 func NewRelay(h host.Host, upgrader transport.Upgrader, opts ...RelayOpt) (*Relay, error) {
-	r := &Relay{
-		upgrader: upgrader,
-		host:     h,
-		self:     h.ID(),
-		incoming: make(chan *Conn),
-		hopCount: make(map[peer.ID]int),
-	}
-	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r := newRelay(h, upgrader)
 
 	for _, opt := range opts {
 		switch opt {
@@ -111,37 +160,90 @@ func NewRelay(h host.Host, upgrader transport.Upgrader, opts ...RelayOpt) (*Rela
 			r.active = true
 		case OptHop:
 			r.hop = true
+		case OptChaining:
+			r.chaining = true
+		case OptResumable:
+			r.resumable = true
 		case OptDiscovery:
 			log.Errorf(
 				"circuit.OptDiscovery is now a no-op: %s",
 				"dialing peers with a random relay is no longer supported",
 			)
 		default:
+			r.ctxCancel()
 			return nil, fmt.Errorf("unrecognized option: %d", opt)
 		}
 	}
 
+	if r.hop {
+		go r.scores.background(r.ctx)
+		go r.tags.background(r.ctx)
+	}
+
+	if r.active {
+		go r.backoff.background(r.ctx)
+	}
+
 	h.SetStreamHandler(ProtoID, r.handleNewStream)
 
 	return r, nil
 }
 
-// Increment the live hop count and increment the connection manager tags by 1 for the two
-// sides of the hop stream. This ensures that connections with many hop streams will be protected
-// from pruning, thus minimizing disruption from connection trimming in a relay node.
-func (r *Relay) addLiveHop(from, to peer.ID) {
+// newRelay constructs a relay with no options, and with no stream handler or
+// background tasks started.
+func newRelay(h host.Host, upgrader transport.Upgrader) *Relay {
+	r := &Relay{
+		upgrader:  upgrader,
+		host:      h,
+		self:      h.ID(),
+		incoming:  make(chan *Conn),
+		backoff:   newDialBackoff(),
+		dstFilter: NewAddrFilter(),
+		srcFilter: NewAddrFilter(),
+		scores:    newScoreboard(),
+		tags:      newTagger(h),
+		sessions:  make(map[sessionKey]*ResumableConn),
+		preferred: make(map[peer.ID]time.Time),
+
+		verifiedRelays: make(map[peer.ID]time.Time),
+		probes:         newProber(),
+		readvertise:    make(chan struct{}, 1),
+	}
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+	r.sched = newScheduler(r.ctx)
+	return r
+}
+
+// Increment the live hop count and update the connection manager tags for the two sides of the
+// hop stream. This ensures that connections with many hop streams will be protected from pruning,
+// thus minimizing disruption from connection trimming in a relay node. It returns the traffic the
+// circuit's bytes are accounted to, for each side.
+func (r *Relay) addLiveHop(from, to peer.ID) []*hopTraffic {
 	atomic.AddInt32(&r.liveHopCount, 1)
-	r.host.ConnManager().UpsertTag(from, "relay-hop-stream", incrementTag)
-	r.host.ConnManager().UpsertTag(to, "relay-hop-stream", incrementTag)
+	return []*hopTraffic{r.tags.open(from), r.tags.open(to)}
 }
 
-// Decrement the live hpo count and decrement the connection manager tags for the two sides
+// Decrement the live hop count and update the connection manager tags for the two sides
 // of the hop stream.
 func (r *Relay) rmLiveHop(from, to peer.ID) {
 	atomic.AddInt32(&r.liveHopCount, -1)
-	r.host.ConnManager().UpsertTag(from, "relay-hop-stream", decrementTag)
-	r.host.ConnManager().UpsertTag(to, "relay-hop-stream", decrementTag)
+	r.tags.close(from)
+	r.tags.close(to)
+}
+
+// SetHopAddrFilter sets the filter applied to destination addresses supplied
+// in hop requests before an active relay adds them to the peerstore and dials
+// them. It should be called before the relay starts serving hop requests.
+func (r *Relay) SetHopAddrFilter(f *AddrFilter) {
+	r.dstFilter = f
+}
 
+// SetStopAddrFilter sets the filter applied to source addresses advertised
+// by relays in stop requests before they are added to the peerstore. A nil
+// filter ignores these addresses entirely. It should be called before the
+// relay starts accepting relayed connections.
+func (r *Relay) SetStopAddrFilter(f *AddrFilter) {
+	r.srcFilter = f
 }
 
 func (r *Relay) GetActiveHops() int32 {
@@ -149,6 +251,29 @@ func (r *Relay) GetActiveHops() int32 {
 }
 
 func (r *Relay) DialPeer(ctx context.Context, relay peer.AddrInfo, dest peer.AddrInfo) (*Conn, error) {
+	return r.DialChain(ctx, []peer.AddrInfo{relay}, dest)
+}
+
+// DialChain opens a circuit to dest through a chain of relays, in order.
+// Chains of more than one relay require OptChaining.
+func (r *Relay) DialChain(ctx context.Context, relays []peer.AddrInfo, dest peer.AddrInfo) (*Conn, error) {
+	return r.dialChain(ctx, relays, dest, nil, false)
+}
+
+// dialChain dials dest through relays; if token is set, the circuit opens or
+// resumes a resumable session.
+func (r *Relay) dialChain(ctx context.Context, relays []peer.AddrInfo, dest peer.AddrInfo, token []byte, resume bool) (*Conn, error) {
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relay to dial %s through", dest.ID)
+	}
+	if len(relays) > 1 && !r.chaining {
+		return nil, fmt.Errorf("can't dial %s through %d relays: relay chaining is disabled", dest.ID, len(relays))
+	}
+	if len(relays) > MaxRelayHops {
+		return nil, fmt.Errorf("can't dial %s through %d relays: at most %d are allowed", dest.ID, len(relays), MaxRelayHops)
+	}
+
+	relay := relays[0]
 
 	log.Debugf("dialing peer %s through relay %s", dest.ID, relay.ID)
 
@@ -170,6 +295,16 @@ func (r *Relay) DialPeer(ctx context.Context, relay peer.AddrInfo, dest peer.Add
 	msg.Type = pb.CircuitRelay_HOP.Enum()
 	msg.SrcPeer = peerInfoToPeer(r.host.Peerstore().PeerInfo(r.self))
 	msg.DstPeer = peerInfoToPeer(dest)
+	if len(relays) > 1 {
+		for _, pi := range relays[1:] {
+			msg.RelayPath = append(msg.RelayPath, peerInfoToPeer(pi))
+		}
+		msg.MaxHops = proto.Uint32(uint32(MaxRelayHops))
+	}
+	if token != nil {
+		msg.SessionToken = token
+		msg.Resume = proto.Bool(resume)
+	}
 
 	err = wr.WriteMsg(&msg)
 	if err != nil {
@@ -195,7 +330,20 @@ func (r *Relay) DialPeer(ctx context.Context, relay peer.AddrInfo, dest peer.Add
 		return nil, RelayError{msg.GetCode()}
 	}
 
-	return &Conn{stream: s, remote: dest, host: r.host, relay: r}, nil
+	path := make([]peer.ID, 0, len(relays)-1)
+	for _, pi := range relays[1:] {
+		path = append(path, pi.ID)
+	}
+	c, err := r.newConn(rd.stream(s), network.DirOutbound, dest, path)
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	c.tagHop()
+	c.startKeepalive()
+	r.usedRelay(relay.ID)
+
+	return c, nil
 }
 
 func (r *Relay) Matches(addr ma.Multiaddr) bool {
@@ -212,6 +360,12 @@ func CanHop(ctx context.Context, host host.Host, id peer.ID) (bool, error) {
 	}
 	defer s.Close()
 
+	return canHop(s)
+}
+
+// canHop queries the peer at the other end of relay stream s for support of
+// hop relay.
+func canHop(s network.Stream) (bool, error) {
 	rd := newDelimitedReader(s, maxMessageSize)
 	wr := newDelimitedWriter(s)
 	defer rd.Close()
@@ -244,6 +398,12 @@ func (r *Relay) CanHop(ctx context.Context, id peer.ID) (bool, error) {
 }
 
 func (r *Relay) handleNewStream(s network.Stream) {
+	if r.hop && r.scores.banned(s.Conn().RemotePeer(), connIP(s.Conn())) {
+		log.Debugf("refusing relay stream from banned peer %s", s.Conn().RemotePeer())
+		s.Reset()
+		return
+	}
+
 	s.SetReadDeadline(time.Now().Add(streamTimeout))
 
 	log.Infof("new relay stream from: %s", s.Conn().RemotePeer())
@@ -255,12 +415,22 @@ func (r *Relay) handleNewStream(s network.Stream) {
 
 	err := rd.ReadMsg(&msg)
 	if err != nil {
-		r.handleError(s, pb.CircuitRelay_MALFORMED_MESSAGE)
+		// only penalize peers for what they sent, not for failing
+		// connections or stalled streams
+		if isMalformed(err) {
+			r.handleError(s, pb.CircuitRelay_MALFORMED_MESSAGE)
+		} else {
+			log.Debugf("error reading relay message from %s: %s", s.Conn().RemotePeer(), err)
+			s.Reset()
+		}
 		return
 	}
 	// reset stream deadline as message has been read
 	s.SetReadDeadline(time.Time{})
 
+	// don't lose any data pipelined after the handshake
+	s = rd.stream(s)
+
 	switch msg.GetType() {
 	case pb.CircuitRelay_HOP:
 		r.handleHopStream(s, &msg)
@@ -289,20 +459,26 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 		s.Reset()
 		return
 	}
-
-	src, err := peerToPeerInfo(msg.GetSrcPeer())
-	if err != nil {
-		r.handleError(s, pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID)
+	if !hopBufferAvailable() {
+		log.Warn("hop buffer budget exhausted; resetting stream")
+		s.Reset()
 		return
 	}
 
-	if src.ID != s.Conn().RemotePeer() {
+	src, err := peerToPeerInfo(msg.GetSrcPeer())
+	if err == errAddrTooLong {
+		r.handleError(s, pb.CircuitRelay_HOP_SRC_ADDR_TOO_LONG)
+		return
+	} else if err != nil {
 		r.handleError(s, pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID)
 		return
 	}
 
 	dst, err := peerToPeerInfo(msg.GetDstPeer())
-	if err != nil {
+	if err == errAddrTooLong {
+		r.handleError(s, pb.CircuitRelay_HOP_DST_ADDR_TOO_LONG)
+		return
+	} else if err != nil {
 		r.handleError(s, pb.CircuitRelay_HOP_DST_MULTIADDR_INVALID)
 		return
 	}
@@ -312,19 +488,75 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 		return
 	}
 
+	chain, code, ok := r.parseChain(msg, src.ID, dst.ID)
+	if !ok {
+		r.handleError(s, code)
+		return
+	}
+
+	if chain.prev != s.Conn().RemotePeer() {
+		r.handleError(s, pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID)
+		return
+	}
+
+	// only relays may forward requests on behalf of another source
+	if chain.prev != src.ID {
+		vctx, vcancel := context.WithTimeout(r.ctx, CanHopTimeout)
+		verified := r.verifyPrevRelay(vctx, chain.prev)
+		vcancel()
+		if !verified {
+			r.handleError(s, pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID)
+			return
+		}
+	}
+
+	// relaying over relayed connections builds chains nobody asked for
+	if !r.chaining && relayed(s.Conn()) {
+		r.handleError(s, pb.CircuitRelay_HOP_RECURSIVE_RELAY)
+		return
+	}
+
+	// the next peer of the circuit: the destination, or the next relay of
+	// the chain
+	next := dst
+	if len(chain.path) > 0 {
+		next = chain.path[0]
+	}
+
 	// open stream
 	ctx, cancel := context.WithTimeout(r.ctx, HopConnectTimeout)
 	defer cancel()
 
 	if !r.active {
 		ctx = network.WithNoDial(ctx, "relay hop")
-	} else if len(dst.Addrs) > 0 {
-		r.host.Peerstore().AddAddrs(dst.ID, dst.Addrs, peerstore.TempAddrTTL)
+	} else {
+		if len(next.Addrs) > 0 {
+			addrs := r.dstFilter.Filter(next.Addrs)
+			if len(addrs) == 0 {
+				log.Debugf("all addresses of relay destination %s were filtered", next.ID.Pretty())
+				r.handleError(s, pb.CircuitRelay_HOP_DST_MULTIADDR_INVALID)
+				return
+			}
+
+			r.host.Peerstore().AddAddrs(next.ID, addrs, peerstore.TempAddrTTL)
+		}
+
+		err = r.dialDst(ctx, next.ID)
+		if err != nil {
+			log.Debugf("error dialing relay destination %s: %s", next.ID.Pretty(), err.Error())
+			if err == errDialBackoff {
+				r.penalize(s, dialBackoffPenalty)
+			} else {
+				r.penalize(s, dialFailurePenalty)
+			}
+			r.handleError(s, pb.CircuitRelay_HOP_CANT_DIAL_DST)
+			return
+		}
 	}
 
-	bs, err := r.host.NewStream(ctx, dst.ID, ProtoID)
+	bs, err := r.host.NewStream(ctx, next.ID, ProtoID)
 	if err != nil {
-		log.Debugf("error opening relay stream to %s: %s", dst.ID.Pretty(), err.Error())
+		log.Debugf("error opening relay stream to %s: %s", next.ID.Pretty(), err.Error())
 		if err == network.ErrNoConn {
 			r.handleError(s, pb.CircuitRelay_HOP_NO_CONN_TO_DST)
 		} else {
@@ -333,7 +565,14 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 		return
 	}
 
-	// stop handshake
+	if !r.chaining && relayed(bs.Conn()) {
+		log.Debugf("refusing to relay to %s over a relayed connection", next.ID.Pretty())
+		bs.Reset()
+		r.handleError(s, pb.CircuitRelay_HOP_RECURSIVE_RELAY)
+		return
+	}
+
+	// stop handshake, or hop handshake with the next relay of the chain
 	rd := newDelimitedReader(bs, maxMessageSize)
 	wr := newDelimitedWriter(bs)
 	defer rd.Close()
@@ -341,7 +580,17 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 	// set handshake deadline
 	bs.SetDeadline(time.Now().Add(StopHandshakeTimeout))
 
-	msg.Type = pb.CircuitRelay_STOP.Enum()
+	if len(chain.path) > 0 {
+		msg.Type = pb.CircuitRelay_HOP.Enum()
+		msg.RelayPath = msg.RelayPath[1:]
+		msg.Visited = chain.visited
+		msg.MaxHops = proto.Uint32(uint32(chain.maxHops))
+	} else {
+		msg.Type = pb.CircuitRelay_STOP.Enum()
+		msg.RelayPath = nil
+		msg.Visited = nil
+		msg.MaxHops = nil
+	}
 
 	err = wr.WriteMsg(msg)
 	if err != nil {
@@ -371,7 +620,12 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 	if msg.GetCode() != pb.CircuitRelay_SUCCESS {
 		log.Debugf("relay stop failure: %d", msg.GetCode())
 		bs.Reset()
-		r.handleError(s, msg.GetCode())
+		if _, ok := penalties[msg.GetCode()]; ok {
+			// don't let the destination get the source penalized
+			r.handleError(s, pb.CircuitRelay_HOP_CANT_OPEN_DST_STREAM)
+		} else {
+			r.handleError(s, msg.GetCode())
+		}
 		return
 	}
 
@@ -389,15 +643,23 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 	// reset deadline
 	bs.SetDeadline(time.Time{})
 
-	r.addLiveHop(src.ID, dst.ID)
+	bs = rd.stream(bs)
+
+	traffic := r.addLiveHop(chain.prev, next.ID)
+
+	c := newCircuit(s, bs, r.sched, src.ID)
+	c.traffic = traffic
+	stopKeepalive := r.keepaliveCircuit(s, bs)
 
 	goroutines := new(int32)
 	*goroutines = 2
 	done := func() {
 		if atomic.AddInt32(goroutines, -1) == 0 {
+			stopKeepalive()
+			c.stop()
 			s.Close()
 			bs.Close()
-			r.rmLiveHop(src.ID, dst.ID)
+			r.rmLiveHop(chain.prev, next.ID)
 		}
 	}
 
@@ -406,11 +668,10 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 	go func() {
 		defer done()
 
-		buf := pool.Get(HopStreamBufferSize)
-		defer pool.Put(buf)
-
-		count, err := io.CopyBuffer(s, bs, buf)
-		if err != nil {
+		count, err := c.copy(s, bs)
+		if err == errCircuitIdle {
+			log.Debugf("closed idle circuit between %s and %s", src.ID.Pretty(), dst.ID.Pretty())
+		} else if err != nil {
 			log.Debugf("relay copy error: %s", err)
 			// Reset both.
 			s.Reset()
@@ -425,11 +686,10 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 	go func() {
 		defer done()
 
-		buf := pool.Get(HopStreamBufferSize)
-		defer pool.Put(buf)
-
-		count, err := io.CopyBuffer(bs, s, buf)
-		if err != nil {
+		count, err := c.copy(bs, s)
+		if err == errCircuitIdle {
+			log.Debugf("closed idle circuit between %s and %s", src.ID.Pretty(), dst.ID.Pretty())
+		} else if err != nil {
 			log.Debugf("relay copy error: %s", err)
 			// Reset both.
 			bs.Reset()
@@ -442,27 +702,64 @@ func (r *Relay) handleHopStream(s network.Stream, msg *pb.CircuitRelay) {
 	}()
 }
 
+// dialDst connects to the hop destination, subject to the destination dial
+// backoff. Concurrent hop requests for the same destination share one dial.
+func (r *Relay) dialDst(ctx context.Context, p peer.ID) error {
+	if r.host.Network().Connectedness(p) == network.Connected {
+		return nil
+	}
+
+	return r.backoff.dial(ctx, p, func(ctx context.Context) error {
+		return r.host.Connect(ctx, peer.AddrInfo{ID: p})
+	})
+}
+
 func (r *Relay) handleStopStream(s network.Stream, msg *pb.CircuitRelay) {
 	src, err := peerToPeerInfo(msg.GetSrcPeer())
-	if err != nil {
+	if err == errAddrTooLong {
+		r.handleError(s, pb.CircuitRelay_STOP_SRC_ADDR_TOO_LONG)
+		return
+	} else if err != nil {
 		r.handleError(s, pb.CircuitRelay_STOP_SRC_MULTIADDR_INVALID)
 		return
 	}
 
 	dst, err := peerToPeerInfo(msg.GetDstPeer())
-	if err != nil || dst.ID != r.self {
+	if err == errAddrTooLong {
+		r.handleError(s, pb.CircuitRelay_STOP_DST_ADDR_TOO_LONG)
+		return
+	} else if err != nil || dst.ID != r.self {
 		r.handleError(s, pb.CircuitRelay_STOP_DST_MULTIADDR_INVALID)
 		return
 	}
 
 	log.Infof("relay connection from: %s", src.ID)
 
+	src.Addrs = r.srcFilter.Filter(src.Addrs)
 	if len(src.Addrs) > 0 {
 		r.host.Peerstore().AddAddrs(src.ID, src.Addrs, peerstore.TempAddrTTL)
 	}
 
+	c, err := r.newConn(s, network.DirInbound, src, nil)
+	if err != nil {
+		r.handleError(s, pb.CircuitRelay_STOP_SRC_MULTIADDR_INVALID)
+		return
+	}
+
+	if token := msg.GetSessionToken(); token != nil {
+		if !r.resumable {
+			r.handleError(s, pb.CircuitRelay_STOP_RESUME_REFUSED)
+			return
+		}
+		if msg.GetResume() {
+			r.resumeSession(c, token)
+			return
+		}
+		c.token = token
+	}
+
 	select {
-	case r.incoming <- &Conn{stream: s, remote: src, host: r.host, relay: r}:
+	case r.incoming <- c:
 	case <-time.After(RelayAcceptTimeout):
 		r.handleError(s, pb.CircuitRelay_STOP_RELAY_REFUSED)
 	}
@@ -487,6 +784,9 @@ func (r *Relay) handleCanHop(s network.Stream, msg *pb.CircuitRelay) {
 
 func (r *Relay) handleError(s network.Stream, code pb.CircuitRelay_Status) {
 	log.Warnf("relay error: %s (%d)", pb.CircuitRelay_Status_name[int32(code)], code)
+	if penalty, ok := penalties[code]; ok {
+		r.penalize(s, penalty)
+	}
 	err := r.writeResponse(s, code)
 	if err != nil {
 		s.Reset()
@@ -496,6 +796,14 @@ func (r *Relay) handleError(s network.Stream, code pb.CircuitRelay_Status) {
 	}
 }
 
+// penalize adds penalty to the score of the peer at the other end of s, on hop
+// relays.
+func (r *Relay) penalize(s network.Stream, penalty float64) {
+	if r.hop {
+		r.scores.penalize(s.Conn().RemotePeer(), connIP(s.Conn()), penalty)
+	}
+}
+
 func (r *Relay) writeResponse(s network.Stream, code pb.CircuitRelay_Status) error {
 	wr := newDelimitedWriter(s)
 
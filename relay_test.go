@@ -1,12 +1,15 @@
 package relay_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,7 +18,12 @@ import (
 
 	bhost "github.com/libp2p/go-libp2p-blankhost"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-msgio/protoio"
 
+	"github.com/gogo/protobuf/proto"
 	swarm "github.com/libp2p/go-libp2p-swarm"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	ma "github.com/multiformats/go-multiaddr"
@@ -59,6 +67,39 @@ func connect(t *testing.T, a, b host.Host) {
 	}
 }
 
+// roundtrip sends a raw relay message to p and returns the status code of the
+// response.
+func roundtrip(t *testing.T, h host.Host, p peer.ID, msg *pb.CircuitRelay) pb.CircuitRelay_Status {
+	s, err := h.NewStream(context.Background(), p, ProtoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := protoio.NewDelimitedWriter(s).WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp pb.CircuitRelay
+	if err := protoio.NewDelimitedReader(s, 4096).ReadMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.GetType() != pb.CircuitRelay_STATUS {
+		t.Fatalf("expected status message, got %d", resp.GetType())
+	}
+
+	return resp.GetCode()
+}
+
+func addrBytes(n int, addr string) [][]byte {
+	addrs := make([][]byte, n)
+	for i := range addrs {
+		addrs[i] = ma.StringCast(addr).Bytes()
+	}
+	return addrs
+}
+
 func TestBasicRelay(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -375,9 +416,12 @@ func TestActiveRelay(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 
 	r1 := newTestRelay(t, hosts[0])
-	newTestRelay(t, hosts[1], OptHop, OptActive)
+	r2 := newTestRelay(t, hosts[1], OptHop, OptActive)
 	r3 := newTestRelay(t, hosts[2])
 
+	// test hosts listen on loopback
+	r2.SetHopAddrFilter(&AddrFilter{AllowPrivate: true})
+
 	connChan := make(chan manet.Conn)
 
 	msg := []byte("relay works!")
@@ -426,6 +470,55 @@ func TestActiveRelay(t *testing.T) {
 	conn1.Close()
 }
 
+func TestActiveRelayFiltersDstAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r1 := newTestRelay(t, hosts[0])
+	newTestRelay(t, hosts[1], OptHop, OptActive)
+	newTestRelay(t, hosts[2])
+
+	rinfo := hosts[1].Peerstore().PeerInfo(hosts[1].ID())
+	dinfo := hosts[2].Peerstore().PeerInfo(hosts[2].ID())
+
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+
+	_, err := r1.DialPeer(rctx, rinfo, dinfo)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	rerr, ok := err.(RelayError)
+	if !ok {
+		t.Fatalf("expected RelayError: %#v", err)
+	}
+
+	if rerr.Code != pb.CircuitRelay_HOP_DST_MULTIADDR_INVALID {
+		t.Fatal("expected 'HOP_DST_MULTIADDR_INVALID' error")
+	}
+
+	if len(hosts[1].Peerstore().Addrs(hosts[2].ID())) != 0 {
+		t.Fatal("filtered addresses were added to the peerstore")
+	}
+
+	// names could resolve to loopback addresses too
+	dinfo.Addrs = []ma.Multiaddr{ma.StringCast("/dns4/localhost/tcp/4001")}
+	_, err = r1.DialPeer(rctx, rinfo, dinfo)
+	if rerr, ok := err.(RelayError); !ok || rerr.Code != pb.CircuitRelay_HOP_DST_MULTIADDR_INVALID {
+		t.Fatalf("expected 'HOP_DST_MULTIADDR_INVALID' error, got %v", err)
+	}
+	if len(hosts[1].Peerstore().Addrs(hosts[2].ID())) != 0 {
+		t.Fatal("filtered addresses were added to the peerstore")
+	}
+}
+
 func TestRelayCanHop(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -449,3 +542,514 @@ func TestRelayCanHop(t *testing.T) {
 		t.Fatal("Relay can't hop")
 	}
 }
+
+func TestRelayAddrTooLong(t *testing.T) {
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	newTestRelay(t, hosts[1], OptHop)
+
+	src := hosts[0].ID()
+	relay := hosts[1].ID()
+	dst := hosts[2].ID()
+
+	for _, addrs := range [][][]byte{
+		addrBytes(MaxPeerAddrs+1, "/ip4/1.2.3.4/tcp/4001"),
+		{make([]byte, MaxAddrLength+1)},
+	} {
+		for _, tc := range []struct {
+			typ      pb.CircuitRelay_Type
+			src, dst *pb.CircuitRelay_Peer
+			code     pb.CircuitRelay_Status
+		}{
+			{
+				pb.CircuitRelay_HOP,
+				&pb.CircuitRelay_Peer{Id: []byte(src), Addrs: addrs},
+				&pb.CircuitRelay_Peer{Id: []byte(dst)},
+				pb.CircuitRelay_HOP_SRC_ADDR_TOO_LONG,
+			},
+			{
+				pb.CircuitRelay_HOP,
+				&pb.CircuitRelay_Peer{Id: []byte(src)},
+				&pb.CircuitRelay_Peer{Id: []byte(dst), Addrs: addrs},
+				pb.CircuitRelay_HOP_DST_ADDR_TOO_LONG,
+			},
+			{
+				pb.CircuitRelay_STOP,
+				&pb.CircuitRelay_Peer{Id: []byte(src), Addrs: addrs},
+				&pb.CircuitRelay_Peer{Id: []byte(relay)},
+				pb.CircuitRelay_STOP_SRC_ADDR_TOO_LONG,
+			},
+			{
+				pb.CircuitRelay_STOP,
+				&pb.CircuitRelay_Peer{Id: []byte(src)},
+				&pb.CircuitRelay_Peer{Id: []byte(relay), Addrs: addrs},
+				pb.CircuitRelay_STOP_DST_ADDR_TOO_LONG,
+			},
+		} {
+			msg := &pb.CircuitRelay{Type: tc.typ.Enum(), SrcPeer: tc.src, DstPeer: tc.dst}
+			if code := roundtrip(t, hosts[0], relay, msg); code != tc.code {
+				t.Fatalf("expected '%s' error, got %s", tc.code, code)
+			}
+		}
+	}
+}
+
+func TestRelayDialManyLocalAddrs(t *testing.T) {
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r1 := newTestRelay(t, hosts[0])
+	newTestRelay(t, hosts[1], OptHop)
+	r3 := newTestRelay(t, hosts[2])
+
+	// the dialer knows more addresses of itself than relays accept, and some
+	// of them are too long
+	var addrs []ma.Multiaddr
+	for i := 0; i < MaxPeerAddrs+10; i++ {
+		addrs = append(addrs, ma.StringCast(fmt.Sprintf("/ip4/10.0.0.1/tcp/%d", 1000+i)))
+	}
+	addrs = append(addrs, ma.StringCast("/dns4/"+strings.Repeat("a", MaxAddrLength)+"/tcp/4001"))
+	hosts[0].Peerstore().AddAddrs(hosts[0].ID(), addrs, peerstore.PermanentAddrTTL)
+
+	connChan := make(chan manet.Conn, 1)
+	go func() {
+		defer close(connChan)
+		conn, err := r3.Listener().Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		connChan <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	addr := ma.StringCast(fmt.Sprintf("/ipfs/%s/p2p-circuit", hosts[1].ID().Pretty()))
+	conn, err := r1.Dial(ctx, addr, hosts[2].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn := <-connChan; conn != nil {
+		conn.Close()
+	}
+}
+
+func TestStopSrcAddrsFiltered(t *testing.T) {
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r2 := newTestRelay(t, hosts[1])
+
+	connChan := make(chan manet.Conn, 1)
+	go func() {
+		defer close(connChan)
+		conn, err := r2.Listener().Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		connChan <- conn
+	}()
+
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	msg := &pb.CircuitRelay{
+		Type: pb.CircuitRelay_STOP.Enum(),
+		SrcPeer: &pb.CircuitRelay_Peer{
+			Id: []byte(hosts[2].ID()),
+			Addrs: [][]byte{
+				public.Bytes(),
+				ma.StringCast("/ip4/127.0.0.1/tcp/4001").Bytes(),
+				ma.StringCast("/ip4/192.168.0.1/tcp/4001").Bytes(),
+				ma.StringCast("/ip4/224.0.0.1/tcp/4001").Bytes(),
+			},
+		},
+		DstPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[1].ID())},
+	}
+
+	if code := roundtrip(t, hosts[0], hosts[1].ID(), msg); code != pb.CircuitRelay_SUCCESS {
+		t.Fatalf("expected success, got %s", code)
+	}
+
+	if conn, ok := <-connChan; ok {
+		conn.Close()
+	}
+
+	addrs := hosts[1].Peerstore().Addrs(hosts[2].ID())
+	if len(addrs) != 1 || !addrs[0].Equal(public) {
+		t.Fatalf("expected only the public address in the peerstore, got %s", addrs)
+	}
+}
+
+func TestRelayBansMisbehavingPeers(t *testing.T) {
+	hosts := getNetHosts(t, 2)
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r2 := newTestRelay(t, hosts[1], OptHop)
+
+	msg := &pb.CircuitRelay{
+		Type:    pb.CircuitRelay_HOP.Enum(),
+		SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[0].ID())},
+		DstPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[1].ID())},
+	}
+
+	for i := 0; i < 10; i++ {
+		if code := roundtrip(t, hosts[0], hosts[1].ID(), msg); code != pb.CircuitRelay_HOP_CANT_RELAY_TO_SELF {
+			t.Fatalf("expected 'HOP_CANT_RELAY_TO_SELF' error, got %s", code)
+		}
+	}
+
+	if len(r2.Bans()) != 0 {
+		t.Fatal("peer banned too early")
+	}
+	if score := r2.PeerScore(hosts[0].ID()); score < 99 || score > 100 {
+		t.Fatalf("unexpected peer score %f", score)
+	}
+
+	// this one pushes the peer over the threshold
+	roundtrip(t, hosts[0], hosts[1].ID(), msg)
+
+	// IP addresses aren't banned by default
+	bans := r2.Bans()
+	if len(bans) != 1 || bans[0].Peer != hosts[0].ID() {
+		t.Fatalf("expected only the peer to be banned, got %v", bans)
+	}
+
+	// the stream may be reset during protocol negotiation or afterwards
+	s, err := hosts[0].NewStream(context.Background(), hosts[1].ID(), ProtoID)
+	if err == nil {
+		err = protoio.NewDelimitedWriter(s).WriteMsg(msg)
+	}
+	if err == nil {
+		err = protoio.NewDelimitedReader(s, 4096).ReadMsg(new(pb.CircuitRelay))
+	}
+	if err == nil {
+		t.Fatal("expected the banned peer's stream to be reset")
+	}
+
+	r2.Unban(hosts[0].ID())
+
+	if code := roundtrip(t, hosts[0], hosts[1].ID(), msg); code != pb.CircuitRelay_HOP_CANT_RELAY_TO_SELF {
+		t.Fatalf("expected 'HOP_CANT_RELAY_TO_SELF' error, got %s", code)
+	}
+}
+
+func TestRelayPenalizesUnreachableDsts(t *testing.T) {
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r2 := newTestRelay(t, hosts[1], OptHop, OptActive)
+
+	// the relay doesn't know the addresses of hosts[2], so it can't dial it
+	msg := &pb.CircuitRelay{
+		Type:    pb.CircuitRelay_HOP.Enum(),
+		SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[0].ID())},
+		DstPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[2].ID())},
+	}
+
+	// the first failed dial costs little, asking again for the backed off
+	// destination costs more
+	for i := 0; i < 3; i++ {
+		if code := roundtrip(t, hosts[0], hosts[1].ID(), msg); code != pb.CircuitRelay_HOP_CANT_DIAL_DST {
+			t.Fatalf("expected 'HOP_CANT_DIAL_DST' error, got %s", code)
+		}
+	}
+	if score := r2.PeerScore(hosts[0].ID()); score < 11.9 || score > 12 {
+		t.Fatalf("unexpected peer score %f", score)
+	}
+
+	// until the peer spamming requests to the destination is banned
+	for i := 0; i < 18; i++ {
+		roundtrip(t, hosts[0], hosts[1].ID(), msg)
+	}
+	if bans := r2.Bans(); len(bans) != 1 || bans[0].Peer != hosts[0].ID() {
+		t.Fatalf("expected the peer to be banned, got %v", bans)
+	}
+}
+
+func TestRelayBansIPs(t *testing.T) {
+	defer func(threshold float64) { IPBanThreshold = threshold }(IPBanThreshold)
+	IPBanThreshold = 150
+
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[2], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r2 := newTestRelay(t, hosts[1], OptHop)
+
+	msg := func(h host.Host) *pb.CircuitRelay {
+		return &pb.CircuitRelay{
+			Type:    pb.CircuitRelay_HOP.Enum(),
+			SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(h.ID())},
+			DstPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[1].ID())},
+		}
+	}
+
+	// the first peer gets banned, but not its IP address
+	for i := 0; i < 11; i++ {
+		roundtrip(t, hosts[0], hosts[1].ID(), msg(hosts[0]))
+	}
+	if bans := r2.Bans(); len(bans) != 1 || bans[0].Peer != hosts[0].ID() {
+		t.Fatalf("expected only the first peer to be banned, got %v", bans)
+	}
+
+	// until another peer on the same IP address pushes it over its threshold
+	for i := 0; i < 5; i++ {
+		roundtrip(t, hosts[2], hosts[1].ID(), msg(hosts[2]))
+	}
+	bans := r2.Bans()
+	if len(bans) != 2 {
+		t.Fatalf("expected the first peer and the IP address to be banned, got %v", bans)
+	}
+
+	var ip net.IP
+	for _, ban := range bans {
+		if ban.IP != nil {
+			ip = ban.IP
+		} else if ban.Peer != hosts[0].ID() {
+			t.Fatalf("unexpected ban %v", ban)
+		}
+	}
+
+	r2.UnbanIP(ip)
+	if code := roundtrip(t, hosts[2], hosts[1].ID(), msg(hosts[2])); code != pb.CircuitRelay_HOP_CANT_RELAY_TO_SELF {
+		t.Fatalf("expected 'HOP_CANT_RELAY_TO_SELF' error, got %s", code)
+	}
+}
+
+func TestRelayPenalizesOnlyMalformedMessages(t *testing.T) {
+	hosts := getNetHosts(t, 2)
+
+	connect(t, hosts[0], hosts[1])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r2 := newTestRelay(t, hosts[1], OptHop)
+
+	send := func(data []byte) {
+		s, err := hosts[0].NewStream(context.Background(), hosts[1].ID(), ProtoID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		s.CloseWrite()
+		ioutil.ReadAll(s)
+		s.Close()
+	}
+
+	// streams closed halfway through a message aren't the peer's fault
+	send(nil)
+	send([]byte{0x05, 0x08})
+	if score := r2.PeerScore(hosts[0].ID()); score != 0 {
+		t.Fatalf("expected truncated messages not to be penalized, got a score of %f", score)
+	}
+
+	send([]byte{0x02, 0xff, 0xff})
+	if score := r2.PeerScore(hosts[0].ID()); score == 0 {
+		t.Fatal("expected an undecodable message to be penalized")
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	timeout := HopIdleTimeout
+	HopIdleTimeout = 200 * time.Millisecond
+	defer func() { HopIdleTimeout = timeout }()
+
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	time.Sleep(10 * time.Millisecond)
+
+	r1 := newTestRelay(t, hosts[0])
+	r2 := newTestRelay(t, hosts[1], OptHop)
+	r3 := newTestRelay(t, hosts[2])
+
+	connChan := make(chan manet.Conn, 1)
+	go func() {
+		defer close(connChan)
+		conn, err := r3.Listener().Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		connChan <- conn
+	}()
+
+	rinfo := hosts[1].Peerstore().PeerInfo(hosts[1].ID())
+	dinfo := hosts[2].Peerstore().PeerInfo(hosts[2].ID())
+
+	rctx, rcancel := context.WithTimeout(context.Background(), time.Second)
+	defer rcancel()
+
+	conn2, err := r1.DialPeer(rctx, rinfo, dinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+
+	conn1, ok := <-connChan
+	if !ok {
+		t.Fatal("listener didn't accept a connection")
+	}
+	defer conn1.Close()
+
+	// traffic keeps the circuit alive
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn2.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn1, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, conn := range []net.Conn{conn1, conn2} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected EOF on idle circuit, got %v", err)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := r2.GetActiveHops(); n != 0 {
+		t.Fatalf("expected no active hops, got %d", n)
+	}
+}
+
+func TestRelayPipelinedData(t *testing.T) {
+	hosts := getNetHosts(t, 3)
+
+	connect(t, hosts[0], hosts[1])
+	connect(t, hosts[1], hosts[2])
+
+	time.Sleep(10 * time.Millisecond)
+
+	newTestRelay(t, hosts[1], OptHop)
+
+	// the destination answers the stop handshake and sends its payload in
+	// a single write.
+	dstErr := make(chan error, 1)
+	hosts[2].SetStreamHandler(ProtoID, func(s network.Stream) {
+		defer s.Close()
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		br := bufio.NewReader(s)
+		var msg pb.CircuitRelay
+		if err := readDelimited(br, &msg); err != nil {
+			dstErr <- err
+			return
+		}
+		if msg.GetType() != pb.CircuitRelay_STOP {
+			dstErr <- fmt.Errorf("expected stop message, got %d", msg.GetType())
+			return
+		}
+
+		resp := delimitedBytes(t, &pb.CircuitRelay{
+			Type: pb.CircuitRelay_STATUS.Enum(),
+			Code: pb.CircuitRelay_SUCCESS.Enum(),
+		})
+		if _, err := s.Write(append(resp, "world"...)); err != nil {
+			dstErr <- err
+			return
+		}
+
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			dstErr <- err
+			return
+		}
+		if string(buf) != "hello" {
+			dstErr <- fmt.Errorf("destination got %q", buf)
+			return
+		}
+		dstErr <- nil
+	})
+
+	s, err := hosts[0].NewStream(context.Background(), hosts[1].ID(), ProtoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// pipeline the payload right after the hop request
+	req := delimitedBytes(t, &pb.CircuitRelay{
+		Type:    pb.CircuitRelay_HOP.Enum(),
+		SrcPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[0].ID())},
+		DstPeer: &pb.CircuitRelay_Peer{Id: []byte(hosts[2].ID())},
+	})
+	if _, err := s.Write(append(req, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(s)
+	var msg pb.CircuitRelay
+	if err := readDelimited(br, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetType() != pb.CircuitRelay_STATUS || msg.GetCode() != pb.CircuitRelay_SUCCESS {
+		t.Fatalf("expected successful status, got %d (%d)", msg.GetType(), msg.GetCode())
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world" {
+		t.Fatalf("source got %q", buf)
+	}
+
+	if err := <-dstErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func delimitedBytes(t *testing.T, msg *pb.CircuitRelay) []byte {
+	var buf bytes.Buffer
+	if err := protoio.NewDelimitedWriter(&buf).WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readDelimited reads a single message from br, leaving any following data
+// buffered.
+func readDelimited(br *bufio.Reader, msg *pb.CircuitRelay) error {
+	mlen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, mlen)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf, msg)
+}
@@ -0,0 +1,107 @@
+package relaytest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ConnManager is a connection manager that records tags and protections, and
+// never prunes connections.
+type ConnManager struct {
+	mx        sync.Mutex
+	tags      map[peer.ID]map[string]int
+	protected map[peer.ID]map[string]struct{}
+}
+
+var _ connmgr.ConnManager = (*ConnManager)(nil)
+
+func newConnManager() *ConnManager {
+	return &ConnManager{
+		tags:      make(map[peer.ID]map[string]int),
+		protected: make(map[peer.ID]map[string]struct{}),
+	}
+}
+
+// Tag returns the weight of tag on p, and whether p has that tag.
+func (cm *ConnManager) Tag(p peer.ID, tag string) (int, bool) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	w, ok := cm.tags[p][tag]
+	return w, ok
+}
+
+func (cm *ConnManager) TagPeer(p peer.ID, tag string, weight int) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	if cm.tags[p] == nil {
+		cm.tags[p] = make(map[string]int)
+	}
+	cm.tags[p][tag] = weight
+}
+
+func (cm *ConnManager) UntagPeer(p peer.ID, tag string) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	delete(cm.tags[p], tag)
+}
+
+func (cm *ConnManager) UpsertTag(p peer.ID, tag string, upsert func(int) int) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	if cm.tags[p] == nil {
+		cm.tags[p] = make(map[string]int)
+	}
+	cm.tags[p][tag] = upsert(cm.tags[p][tag])
+}
+
+func (cm *ConnManager) GetTagInfo(p peer.ID) *connmgr.TagInfo {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	info := &connmgr.TagInfo{FirstSeen: time.Now(), Tags: make(map[string]int)}
+	for tag, w := range cm.tags[p] {
+		info.Tags[tag] = w
+		info.Value += w
+	}
+	return info
+}
+
+func (cm *ConnManager) TrimOpenConns(context.Context) {}
+
+func (cm *ConnManager) Notifee() network.Notifiee {
+	return new(network.NoopNotifiee)
+}
+
+func (cm *ConnManager) Protect(p peer.ID, tag string) {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	if cm.protected[p] == nil {
+		cm.protected[p] = make(map[string]struct{})
+	}
+	cm.protected[p][tag] = struct{}{}
+}
+
+func (cm *ConnManager) Unprotect(p peer.ID, tag string) bool {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	delete(cm.protected[p], tag)
+	return len(cm.protected[p]) > 0
+}
+
+func (cm *ConnManager) IsProtected(p peer.ID, tag string) bool {
+	cm.mx.Lock()
+	defer cm.mx.Unlock()
+	if tag == "" {
+		return len(cm.protected[p]) > 0
+	}
+	_, ok := cm.protected[p][tag]
+	return ok
+}
+
+func (cm *ConnManager) Close() error {
+	return nil
+}
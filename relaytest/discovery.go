@@ -0,0 +1,97 @@
+package relaytest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Discovery is an in-memory rendezvous point: peers advertise themselves
+// under namespaces through its clients, and find the peers advertised there.
+type Discovery struct {
+	mx sync.Mutex
+	// TTL is the TTL of the advertisements that don't set one.
+	TTL time.Duration
+	ads map[string]map[peer.ID]advertisement
+}
+
+type advertisement struct {
+	info    peer.AddrInfo
+	expires time.Time
+}
+
+// NewDiscovery returns an empty rendezvous point; advertisements last an hour
+// by default.
+func NewDiscovery() *Discovery {
+	return &Discovery{
+		TTL: time.Hour,
+		ads: make(map[string]map[peer.ID]advertisement),
+	}
+}
+
+// Client returns the discovery client of host h.
+func (d *Discovery) Client(h host.Host) discovery.Discovery {
+	return &discoveryClient{d: d, h: h}
+}
+
+type discoveryClient struct {
+	d *Discovery
+	h host.Host
+}
+
+func (c *discoveryClient) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return 0, err
+	}
+
+	c.d.mx.Lock()
+	defer c.d.mx.Unlock()
+
+	ttl := options.Ttl
+	if ttl == 0 {
+		ttl = c.d.TTL
+	}
+	if c.d.ads[ns] == nil {
+		c.d.ads[ns] = make(map[peer.ID]advertisement)
+	}
+	c.d.ads[ns][c.h.ID()] = advertisement{
+		info:    c.h.Peerstore().PeerInfo(c.h.ID()),
+		expires: time.Now().Add(ttl),
+	}
+	return ttl, nil
+}
+
+func (c *discoveryClient) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	var options discovery.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	c.d.mx.Lock()
+	defer c.d.mx.Unlock()
+
+	now := time.Now()
+	var found []peer.AddrInfo
+	for p, ad := range c.d.ads[ns] {
+		if !now.Before(ad.expires) {
+			delete(c.d.ads[ns], p)
+			continue
+		}
+		if options.Limit > 0 && len(found) == options.Limit {
+			break
+		}
+		found = append(found, ad.info)
+	}
+
+	ch := make(chan peer.AddrInfo, len(found))
+	for _, pi := range found {
+		ch <- pi
+	}
+	close(ch)
+	return ch, nil
+}
@@ -0,0 +1,470 @@
+// Package relaytest builds relay topologies on an in-memory network, so that
+// relay users can be tested without real networking.
+//
+// A Topology declares the relay role of each node and the links between them.
+// Nodes are only reachable over links, and NATed nodes can't be dialed at all,
+// so they can only be reached through relays. Links can be slowed down with a
+// latency and a bandwidth cap, and their connections dropped; nodes can be
+// crashed.
+package relaytest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	relay "github.com/libp2p/go-libp2p-circuit"
+
+	bhost "github.com/libp2p/go-libp2p-blankhost"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+
+	csms "github.com/libp2p/go-conn-security-multistream"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	yamux "github.com/libp2p/go-libp2p-yamux"
+	msmux "github.com/libp2p/go-stream-muxer-multistream"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Role is the relay role of a node; roles can be combined.
+type Role int
+
+// Client nodes can dial and accept relayed connections, but don't relay for
+// others.
+const Client Role = 0
+
+const (
+	// Hop nodes relay connections between peers they are connected to.
+	Hop Role = 1 << iota
+	// Active nodes dial relay destinations they aren't connected to; it only
+	// makes sense along with Hop.
+	Active
+	// NATed nodes don't listen, so they can only be reached through relays.
+	NATed
+	// Chaining nodes dial circuits through chains of relays, and relay them
+	// along with Hop.
+	Chaining
+	// Resumable nodes dial and accept resumable circuits.
+	Resumable
+)
+
+// Topology declares a network.
+type Topology struct {
+	// Nodes are the roles of the nodes, which are identified by their index.
+	Nodes []Role
+	// Links are the pairs of nodes that can reach each other. Linked nodes
+	// are connected when the network is built, unless both are NATed.
+	Links [][2]int
+	// NoRelayTransport leaves relayed connections to Relay.Listener, instead
+	// of adding the relay transport to the network of the hosts.
+	NoRelayTransport bool
+}
+
+// Line declares a network of nodes with the given roles, each linked to its
+// neighbours only, whose relayed connections are left to Relay.Listener.
+func Line(roles ...Role) Topology {
+	var links [][2]int
+	for i := 1; i < len(roles); i++ {
+		links = append(links, [2]int{i - 1, i})
+	}
+	return Topology{Nodes: roles, Links: links, NoRelayTransport: true}
+}
+
+// Node is a node of a network.
+type Node struct {
+	Host  host.Host
+	Relay *relay.Relay
+	Role  Role
+	// ConnMgr is the connection manager of the host.
+	ConnMgr *ConnManager
+
+	tb testing.TB
+}
+
+// Info returns the peer info of the node.
+func (n *Node) Info() peer.AddrInfo {
+	return n.Host.Peerstore().PeerInfo(n.Host.ID())
+}
+
+// Accept starts accepting the next relayed connection of the relay of the
+// node, from Relay.Listener, and returns a function waiting for it. The
+// function fails the test if accepting fails, so it must be called from the
+// test goroutine.
+func (n *Node) Accept() func() net.Conn {
+	type accepted struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		c, err := n.Relay.Listener().Accept()
+		ch <- accepted{c, err}
+	}()
+	return func() net.Conn {
+		n.tb.Helper()
+
+		a := <-ch
+		if a.err != nil {
+			n.tb.Fatal(a.err)
+		}
+		return a.c
+	}
+}
+
+// AcceptAll accepts the relayed connections of the relay of the node, from
+// Relay.Listener, until the relay is closed.
+func (n *Node) AcceptAll() <-chan net.Conn {
+	conns := make(chan net.Conn, 64)
+	go func() {
+		for {
+			c, err := n.Relay.Listener().Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	return conns
+}
+
+// Network is an in-memory network of relay nodes.
+type Network struct {
+	tb    testing.TB
+	Nodes []*Node
+
+	mx        sync.Mutex
+	links     map[[2]int]*Link
+	listeners map[int]*memListener
+	crashed   map[int]bool
+}
+
+// New builds the network declared by topo. The network is torn down when the
+// test ends.
+func New(tb testing.TB, topo Topology) *Network {
+	n := &Network{
+		tb:        tb,
+		links:     make(map[[2]int]*Link),
+		listeners: make(map[int]*memListener),
+		crashed:   make(map[int]bool),
+	}
+
+	for i, role := range topo.Nodes {
+		n.Nodes = append(n.Nodes, n.newNode(i, role, !topo.NoRelayTransport))
+	}
+	tb.Cleanup(n.close)
+
+	for _, l := range topo.Links {
+		n.Link(l[0], l[1])
+	}
+	for _, l := range topo.Links {
+		switch {
+		case n.Nodes[l[1]].Role&NATed == 0:
+			n.Connect(l[0], l[1])
+		case n.Nodes[l[0]].Role&NATed == 0:
+			n.Connect(l[1], l[0])
+		}
+	}
+
+	return n
+}
+
+func (n *Network) newNode(i int, role Role, addTransport bool) *Node {
+	tb := n.tb
+
+	// deterministic identities
+	sk, _, err := crypto.GenerateEd25519Key(rand.New(rand.NewSource(int64(i))))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ps.AddPrivKey(id, sk)
+	ps.AddPubKey(id, sk.GetPublic())
+
+	s, err := swarm.NewSwarm(id, ps)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	secMuxer := new(csms.SSMuxer)
+	secMuxer.AddTransport(insecure.ID, insecure.NewWithIdentity(id, sk))
+	// lift the limit on incoming streams, to carry as many circuits as the
+	// relays accept
+	muxer := *yamux.DefaultTransport
+	muxer.MaxIncomingStreams = uint32(relay.HopStreamLimit)
+	stMuxer := msmux.NewBlankTransport()
+	stMuxer.AddTransport("/yamux/1.0.0", &muxer)
+	upgrader, err := tptu.New(secMuxer, stMuxer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := s.AddTransport(&memTransport{net: n, node: i, upgrader: upgrader}); err != nil {
+		tb.Fatal(err)
+	}
+	if role&NATed == 0 {
+		if err := s.Listen(n.addr(i)); err != nil {
+			tb.Fatal(err)
+		}
+		ps.AddAddrs(id, s.ListenAddresses(), peerstore.PermanentAddrTTL)
+	}
+
+	cm := newConnManager()
+	h := bhost.NewBlankHost(s, bhost.WithConnectionManager(cm))
+
+	var opts []relay.RelayOpt
+	if role&Hop != 0 {
+		opts = append(opts, relay.OptHop)
+	}
+	if role&Active != 0 {
+		opts = append(opts, relay.OptActive)
+	}
+	if role&Chaining != 0 {
+		opts = append(opts, relay.OptChaining)
+	}
+	if role&Resumable != 0 {
+		opts = append(opts, relay.OptResumable)
+	}
+	r, err := relay.NewRelay(h, upgrader, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// all addresses are private on the in-memory network
+	r.SetHopAddrFilter(&relay.AddrFilter{AllowPrivate: true})
+	r.SetStopAddrFilter(&relay.AddrFilter{AllowPrivate: true})
+
+	if addTransport {
+		if err := s.AddTransport(r.Transport()); err != nil {
+			tb.Fatal(err)
+		}
+		if err := s.Listen(r.Listener().Multiaddr()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return &Node{Host: h, Relay: r, Role: role, ConnMgr: cm, tb: tb}
+}
+
+// addr returns the listen address of node i.
+func (n *Network) addr(i int) ma.Multiaddr {
+	return ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4001+i))
+}
+
+// Link links nodes a and b, if they aren't already, and returns their link.
+func (n *Network) Link(a, b int) *Link {
+	if a > b {
+		a, b = b, a
+	}
+	if a == b || a < 0 || b >= len(n.Nodes) {
+		n.tb.Fatalf("invalid link %d-%d", a, b)
+	}
+
+	n.mx.Lock()
+	l, ok := n.links[[2]int{a, b}]
+	if !ok {
+		l = &Link{conns: make(map[*memConn]struct{})}
+		n.links[[2]int{a, b}] = l
+	}
+	n.mx.Unlock()
+
+	if !ok {
+		for _, pair := range [][2]int{{a, b}, {b, a}} {
+			from, to := n.Nodes[pair[0]], n.Nodes[pair[1]]
+			if to.Role&NATed == 0 {
+				from.Host.Peerstore().AddAddr(to.Host.ID(), n.addr(pair[1]), peerstore.PermanentAddrTTL)
+			}
+		}
+	}
+
+	return l
+}
+
+// Connect connects node a to node b.
+func (n *Network) Connect(a, b int) {
+	if err := n.Nodes[a].Host.Connect(context.Background(), n.Nodes[b].Info()); err != nil {
+		n.tb.Fatalf("connecting %d to %d: %s", a, b, err)
+	}
+}
+
+// DialRelayed opens a relayed connection from node src to node dst through
+// node r.
+func (n *Network) DialRelayed(ctx context.Context, src, r, dst int) (*relay.Conn, error) {
+	return n.Nodes[src].Relay.DialPeer(ctx, n.Nodes[r].Info(), peer.AddrInfo{ID: n.Nodes[dst].Host.ID()})
+}
+
+// Crash drops all the connections of node i and shuts it down.
+func (n *Network) Crash(i int) {
+	n.mx.Lock()
+	if n.crashed[i] {
+		n.mx.Unlock()
+		return
+	}
+	n.crashed[i] = true
+	l := n.listeners[i]
+	var links []*Link
+	for pair, lnk := range n.links {
+		if pair[0] == i || pair[1] == i {
+			links = append(links, lnk)
+		}
+	}
+	n.mx.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+	for _, lnk := range links {
+		lnk.Drop()
+	}
+
+	n.Nodes[i].Relay.Transport().Close()
+	n.Nodes[i].Host.Close()
+}
+
+// Crashed returns true if node i was crashed.
+func (n *Network) Crashed(i int) bool {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.crashed[i]
+}
+
+func (n *Network) close() {
+	for i, node := range n.Nodes {
+		if !n.Crashed(i) {
+			node.Relay.Transport().Close()
+			node.Host.Close()
+		}
+		node.Host.Peerstore().Close()
+	}
+}
+
+func (n *Network) listen(i int) (*memListener, error) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if n.crashed[i] {
+		return nil, fmt.Errorf("node %d crashed", i)
+	}
+	if _, ok := n.listeners[i]; ok {
+		return nil, fmt.Errorf("node %d is already listening", i)
+	}
+
+	l := &memListener{
+		net:      n,
+		node:     i,
+		addr:     n.addr(i),
+		incoming: make(chan manet.Conn),
+		closed:   make(chan struct{}),
+	}
+	n.listeners[i] = l
+	return l, nil
+}
+
+func (n *Network) unlisten(l *memListener) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if n.listeners[l.node] == l {
+		delete(n.listeners, l.node)
+	}
+}
+
+// route returns the listener at addr and the link to it from node i.
+func (n *Network) route(i int, addr ma.Multiaddr) (*memListener, *Link, error) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if n.crashed[i] {
+		return nil, nil, fmt.Errorf("node %d crashed", i)
+	}
+
+	for j, l := range n.listeners {
+		if !l.addr.Equal(addr) {
+			continue
+		}
+
+		pair := [2]int{i, j}
+		if j < i {
+			pair = [2]int{j, i}
+		}
+		lnk, ok := n.links[pair]
+		if !ok {
+			return nil, nil, errNoRoute
+		}
+		return l, lnk, nil
+	}
+
+	return nil, nil, fmt.Errorf("no listener on %s", addr)
+}
+
+// Link is a link between two nodes.
+type Link struct {
+	mx        sync.Mutex
+	latency   time.Duration
+	bandwidth int
+	conns     map[*memConn]struct{}
+}
+
+// SetLatency sets the one-way latency of the link.
+func (l *Link) SetLatency(d time.Duration) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.latency = d
+}
+
+// SetBandwidth caps the bandwidth, in bytes per second, of each direction of
+// each connection over the link. Zero, the default, means unlimited.
+func (l *Link) SetBandwidth(bytesPerSecond int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.bandwidth = bytesPerSecond
+}
+
+// Drop breaks all the connections over the link; reads and writes on them
+// fail with ErrConnDropped. New connections can be established afterwards.
+func (l *Link) Drop() {
+	l.mx.Lock()
+	conns := make([]*memConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mx.Unlock()
+
+	for _, c := range conns {
+		c.drop()
+	}
+}
+
+func (l *Link) params() (time.Duration, int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.latency, l.bandwidth
+}
+
+func (l *Link) add(c *memConn) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.conns[c] = struct{}{}
+}
+
+func (l *Link) remove(c *memConn) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	delete(l.conns, c)
+}
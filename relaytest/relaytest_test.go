@@ -0,0 +1,243 @@
+package relaytest_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const echoProto = "/relaytest/echo"
+
+func echo(s network.Stream) {
+	defer s.Close()
+	io.Copy(s, s)
+}
+
+// roundtrip writes msg to s and reads it back.
+func roundtrip(t *testing.T, s io.ReadWriter, msg []byte) {
+	t.Helper()
+
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("message was incorrect")
+	}
+}
+
+func TestRelayedStreamBetweenNATedNodes(t *testing.T) {
+	n := New(t, Topology{
+		Nodes: []Role{NATed, Hop, NATed},
+		Links: [][2]int{{0, 1}, {1, 2}},
+	})
+	src, rel, dst := n.Nodes[0], n.Nodes[1], n.Nodes[2]
+
+	dst.Host.SetStreamHandler(echoProto, echo)
+
+	// NATed nodes can't be dialed directly
+	if err := src.Host.Connect(context.Background(), peer.AddrInfo{ID: dst.Host.ID()}); err == nil {
+		t.Fatal("expected a direct dial to a NATed node to fail")
+	}
+
+	circuit := ma.StringCast("/p2p/" + rel.Host.ID().Pretty() + "/p2p-circuit")
+	src.Host.Peerstore().AddAddr(dst.Host.ID(), circuit, peerstore.TempAddrTTL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := src.Host.NewStream(ctx, dst.Host.ID(), echoProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	roundtrip(t, s, []byte("relay works!"))
+
+	if rel.Relay.GetActiveHops() != 1 {
+		t.Fatalf("expected 1 active hop, got %d", rel.Relay.GetActiveHops())
+	}
+}
+
+func TestDeterministicIdentities(t *testing.T) {
+	topo := Topology{Nodes: []Role{Client, Hop}}
+	a, b := New(t, topo), New(t, topo)
+	for i := range a.Nodes {
+		if a.Nodes[i].Host.ID() != b.Nodes[i].Host.ID() {
+			t.Fatalf("node %d has different identities", i)
+		}
+	}
+	if a.Nodes[0].Host.ID() == a.Nodes[1].Host.ID() {
+		t.Fatal("nodes share an identity")
+	}
+}
+
+func TestActiveRelay(t *testing.T) {
+	n := New(t, Topology{
+		Nodes:            []Role{Client, Hop | Active, Client},
+		Links:            [][2]int{{0, 1}},
+		NoRelayTransport: true,
+	})
+	// the relay can reach the destination, but isn't connected to it
+	n.Link(1, 2)
+
+	accept := n.Nodes[2].Accept()
+
+	c, err := n.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := accept()
+	defer dc.Close()
+
+	go io.Copy(dc, dc)
+	roundtrip(t, c, []byte("active relay works!"))
+}
+
+func TestLinkLatency(t *testing.T) {
+	n := New(t, Topology{
+		Nodes: []Role{Client, Client},
+		Links: [][2]int{{0, 1}},
+	})
+	n.Nodes[1].Host.SetStreamHandler(echoProto, echo)
+
+	s, err := n.Nodes[0].Host.NewStream(context.Background(), n.Nodes[1].Host.ID(), echoProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	roundtrip(t, s, []byte("warm up"))
+
+	const latency = 50 * time.Millisecond
+	n.Link(0, 1).SetLatency(latency)
+
+	start := time.Now()
+	roundtrip(t, s, []byte("ping"))
+	if rtt := time.Since(start); rtt < 2*latency {
+		t.Fatalf("expected a round trip of at least %s, got %s", 2*latency, rtt)
+	}
+}
+
+func TestLinkBandwidth(t *testing.T) {
+	n := New(t, Topology{
+		Nodes: []Role{Client, Client},
+		Links: [][2]int{{0, 1}},
+	})
+	n.Nodes[1].Host.SetStreamHandler(echoProto, func(s network.Stream) {
+		defer s.Close()
+		io.Copy(ioutil.Discard, s)
+	})
+
+	const bandwidth = 64 << 10
+	n.Link(0, 1).SetBandwidth(bandwidth)
+
+	s, err := n.Nodes[0].Host.NewStream(context.Background(), n.Nodes[1].Host.ID(), echoProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := s.Write(make([]byte, bandwidth/2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the handler to close its side
+	if _, err := io.Copy(ioutil.Discard, s); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("sent %d bytes at %d B/s in %s", bandwidth/2, bandwidth, elapsed)
+	}
+}
+
+func TestLinkDrop(t *testing.T) {
+	n := New(t, Topology{
+		Nodes:            []Role{Client, Hop, Client},
+		Links:            [][2]int{{0, 1}, {1, 2}},
+		NoRelayTransport: true,
+	})
+
+	accept := n.Nodes[2].Accept()
+
+	c, err := n.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := accept()
+	defer dc.Close()
+
+	n.Link(1, 2).Drop()
+
+	dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dc.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("expected the relayed connection to break, got %v", err)
+	}
+
+	// the link can be used again
+	n.Connect(2, 1)
+	accept = n.Nodes[2].Accept()
+	c, err = n.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	accept().Close()
+}
+
+func TestRelayCrash(t *testing.T) {
+	n := New(t, Topology{
+		Nodes:            []Role{Client, Hop, Client},
+		Links:            [][2]int{{0, 1}, {1, 2}},
+		NoRelayTransport: true,
+	})
+
+	accept := n.Nodes[2].Accept()
+
+	c, err := n.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dc := accept()
+	defer dc.Close()
+
+	n.Crash(1)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("expected the relayed connection to break, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := n.DialRelayed(ctx, 0, 1, 2); err == nil {
+		t.Fatal("expected dialing through a crashed relay to fail")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
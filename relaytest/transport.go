@@ -0,0 +1,386 @@
+package relaytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// maximum number of bytes in flight in one direction of a connection before
+// writes block
+const maxInFlight = 1 << 20
+
+var (
+	// ErrConnDropped is returned by reads and writes on connections that
+	// were dropped by Link.Drop or Network.Crash.
+	ErrConnDropped = errors.New("connection dropped")
+
+	errNoRoute = errors.New("no route to host")
+)
+
+// memTransport is the transport of a node: it dials the listeners of other
+// nodes over the links of the node.
+type memTransport struct {
+	net      *Network
+	node     int
+	upgrader transport.Upgrader
+}
+
+var _ transport.Transport = (*memTransport)(nil)
+
+func (t *memTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	l, lnk, err := t.net.route(t.node, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	laddr := t.net.addr(t.node)
+	a, b := newPipe(lnk), newPipe(lnk)
+	local := &memConn{r: a, w: b, link: lnk, laddr: laddr, raddr: raddr}
+	remote := &memConn{r: b, w: a, link: lnk, laddr: raddr, raddr: laddr}
+	lnk.add(local)
+
+	select {
+	case l.incoming <- remote:
+	case <-l.closed:
+		local.drop()
+		return nil, fmt.Errorf("listener on %s closed", raddr)
+	case <-ctx.Done():
+		local.drop()
+		return nil, ctx.Err()
+	}
+
+	scope, _ := network.NullResourceManager.OpenConnection(network.DirOutbound, false)
+	return t.upgrader.Upgrade(ctx, t, local, network.DirOutbound, p, scope)
+}
+
+func (t *memTransport) CanDial(addr ma.Multiaddr) bool {
+	protos := addr.Protocols()
+	return len(protos) == 2 && protos[0].Code == ma.P_IP4 && protos[1].Code == ma.P_TCP
+}
+
+func (t *memTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	l, err := t.net.listen(t.node)
+	if err != nil {
+		return nil, err
+	}
+	return t.upgrader.UpgradeListener(t, l), nil
+}
+
+func (t *memTransport) Protocols() []int {
+	return []int{ma.P_TCP}
+}
+
+func (t *memTransport) Proxy() bool {
+	return false
+}
+
+type memListener struct {
+	net       *Network
+	node      int
+	addr      ma.Multiaddr
+	incoming  chan manet.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (manet.Conn, error) {
+	select {
+	case c := <-l.incoming:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener on %s closed", l.addr)
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.net.unlisten(l)
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	na, _ := manet.ToNetAddr(l.addr)
+	return na
+}
+
+func (l *memListener) Multiaddr() ma.Multiaddr {
+	return l.addr
+}
+
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// pipe is one direction of a connection. Written data is delivered to the
+// reader after the latency of the link, and after the data written before it
+// went through the bandwidth of the link.
+type pipe struct {
+	link *Link
+
+	mx       sync.Mutex
+	chunks   []chunk
+	inFlight int
+	nextFree time.Time
+	closed   bool
+	err      error
+	// closed and replaced on every state change
+	changed chan struct{}
+}
+
+func newPipe(l *Link) *pipe {
+	return &pipe{link: l, changed: make(chan struct{})}
+}
+
+// must be called with the lock held.
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// wait blocks until the pipe changes, the deadline or until passes, or the
+// deadline changes; it must be called with the lock held and returns with the
+// lock held.
+func (p *pipe) wait(dl *deadline, until time.Time) {
+	changed := p.changed
+	dlChanged := dl.changed()
+	p.mx.Unlock()
+	defer p.mx.Lock()
+
+	var timeout <-chan time.Time
+	if t := dl.get(); !t.IsZero() && (until.IsZero() || t.Before(until)) {
+		until = t
+	}
+	if !until.IsZero() {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-changed:
+	case <-dlChanged:
+	case <-timeout:
+	}
+}
+
+func (p *pipe) read(b []byte, dl *deadline) (int, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for {
+		if p.err != nil {
+			return 0, p.err
+		}
+
+		now := time.Now()
+		if dl.exceeded(now) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		var until time.Time
+		if len(p.chunks) > 0 {
+			if c := &p.chunks[0]; !now.Before(c.at) {
+				n := copy(b, c.data)
+				c.data = c.data[n:]
+				if len(c.data) == 0 {
+					p.chunks = p.chunks[1:]
+				}
+				p.inFlight -= n
+				p.notify()
+				return n, nil
+			}
+			until = p.chunks[0].at
+		} else if p.closed {
+			return 0, io.EOF
+		}
+
+		p.wait(dl, until)
+	}
+}
+
+func (p *pipe) write(b []byte, dl *deadline) (int, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if dl.exceeded(time.Now()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if p.inFlight < maxInFlight {
+			break
+		}
+		p.wait(dl, time.Time{})
+	}
+
+	latency, bandwidth := p.link.params()
+
+	now := time.Now()
+	start := p.nextFree
+	if start.Before(now) {
+		start = now
+	}
+	p.nextFree = start
+	if bandwidth > 0 {
+		p.nextFree = start.Add(time.Duration(int64(len(b)) * int64(time.Second) / int64(bandwidth)))
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	p.chunks = append(p.chunks, chunk{data: data, at: p.nextFree.Add(latency)})
+	p.inFlight += len(b)
+	p.notify()
+
+	return len(b), nil
+}
+
+// close makes reads return EOF once the data in flight has been read.
+func (p *pipe) close() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.notify()
+	}
+}
+
+// fail discards the data in flight and makes reads and writes return err.
+func (p *pipe) fail(err error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.err == nil {
+		p.err = err
+		p.chunks = nil
+		p.inFlight = 0
+		p.notify()
+	}
+}
+
+type deadline struct {
+	mx sync.Mutex
+	t  time.Time
+	// closed and replaced when the deadline is set
+	ch chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.t = t
+	if d.ch != nil {
+		close(d.ch)
+		d.ch = nil
+	}
+}
+
+func (d *deadline) get() time.Time {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.t
+}
+
+func (d *deadline) changed() <-chan struct{} {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
+
+func (d *deadline) exceeded(now time.Time) bool {
+	t := d.get()
+	return !t.IsZero() && !now.Before(t)
+}
+
+// memConn is one end of a connection between two nodes.
+type memConn struct {
+	r, w         *pipe
+	link         *Link
+	laddr, raddr ma.Multiaddr
+
+	rdl, wdl deadline
+}
+
+var _ manet.Conn = (*memConn)(nil)
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.r.read(b, &c.rdl)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	return c.w.write(b, &c.wdl)
+}
+
+func (c *memConn) Close() error {
+	c.w.close()
+	c.r.fail(net.ErrClosed)
+	c.link.remove(c)
+	return nil
+}
+
+// drop breaks both directions of the connection.
+func (c *memConn) drop() {
+	c.r.fail(ErrConnDropped)
+	c.w.fail(ErrConnDropped)
+	c.link.remove(c)
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.rdl.set(t)
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.rdl.set(t)
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.wdl.set(t)
+	return nil
+}
+
+func (c *memConn) LocalMultiaddr() ma.Multiaddr {
+	return c.laddr
+}
+
+func (c *memConn) RemoteMultiaddr() ma.Multiaddr {
+	return c.raddr
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	na, _ := manet.ToNetAddr(c.laddr)
+	return na
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	na, _ := manet.ToNetAddr(c.raddr)
+	return na
+}
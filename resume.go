@@ -0,0 +1,947 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+var (
+	// ResumeTimeout is how long a resumable connection whose circuit broke
+	// waits to be resumed before failing; the dialer keeps redialing its
+	// relays until then.
+	ResumeTimeout = 1 * time.Minute
+
+	// ResumeBufferSize is the amount of data written to a resumable
+	// connection that the remote peer may not have acknowledged yet; writes
+	// block beyond it. Peers sending more unacknowledged data than that fail
+	// the connection; both ends must use the same size.
+	ResumeBufferSize = 1 << 20
+)
+
+// Frames of the resumable connection protocol: a type byte, followed by a
+// uvarint value, followed by the payload of data frames.
+const (
+	// value: the payload length
+	frameData byte = iota
+	// value: the number of bytes received from the peer that it may forget
+	frameAck
+	// value: the total number of bytes sent before closing for writing
+	frameClose
+	// value: unused
+	frameReset
+	// value: the nonce length; only sent when authenticating
+	frameNonce
+	// value: the payload length; payload: the uvarint length of the
+	// marshalled public key of the sender, the key, and the signature. Only
+	// sent when authenticating.
+	frameAuth
+	// value: unused; sent by the destination of a new resumable connection,
+	// before anything else, to confirm it speaks the protocol
+	frameHello
+)
+
+const (
+	maxFrameSize     = 1 << 16
+	sessionTokenSize = 16
+)
+
+// ErrResumeUnsupported is returned by DialResumable when the destination
+// accepts the circuit without confirming it speaks the resumable connection
+// protocol.
+var ErrResumeUnsupported = errors.New("destination doesn't support resumable connections")
+
+var (
+	errSessionReset  = errors.New("resumable connection reset by peer")
+	errResumeTimeout = errors.New("timed out resuming relayed connection")
+)
+
+type sessionKey struct {
+	peer  peer.ID
+	token string
+}
+
+var _ manet.Conn = (*ResumableConn)(nil)
+
+// ResumableConn is a relayed connection that survives the failure of its
+// circuit, e.g. when the relay restarts: the dialer redials the destination
+// through its relays, and both ends resume the byte stream where the old
+// circuit left it.
+//
+// Data is buffered until the remote peer acknowledges it, up to
+// ResumeBufferSize, and retransmitted over the new circuit when resuming.
+// Both ends authenticate each other with their peer keys before resuming, so
+// that the relays can't take the connection over.
+type ResumableConn struct {
+	relay  *Relay
+	key    sessionKey
+	remote peer.ID
+	// redial opens a circuit resuming the session; nil on the accepting
+	// side, which waits for the dialer to resume it.
+	redial func(ctx context.Context) (*Conn, error)
+
+	// serializes writes to the circuit; acquired before mx
+	wmx sync.Mutex
+
+	// acks are sent by a goroutine of their own, so that reading frames
+	// never waits for writes
+	ackCh     chan struct{}
+	done      chan struct{}
+	closeDone sync.Once
+
+	mx   sync.Mutex
+	cond *sync.Cond
+
+	// the current circuit, nil while the connection is broken, and its
+	// generation
+	conn *Conn
+	gen  int
+	// true once the current circuit is resumed and can be written to
+	ready bool
+	// the latest circuit, for the addresses of the connection
+	last *Conn
+
+	resuming bool
+	expiry   *time.Timer
+
+	// unacknowledged data, starting at offset sendBase of the stream
+	sendBuf  []byte
+	sendBase uint64
+
+	// received data, not read yet
+	recvBuf []byte
+	// received, consumed and acknowledged byte counts
+	received, consumed, acked uint64
+
+	localClosed, remoteClosed, readClosed bool
+	finished                              bool
+	err                                   error
+
+	rdl, wdl       time.Time
+	rtimer, wtimer *time.Timer
+}
+
+func newResumableConn(r *Relay, remote peer.ID, token []byte) *ResumableConn {
+	rc := &ResumableConn{
+		relay:  r,
+		key:    sessionKey{peer: remote, token: string(token)},
+		remote: remote,
+		ackCh:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	rc.cond = sync.NewCond(&rc.mx)
+	go rc.ackLoop()
+	return rc
+}
+
+// DialResumable opens a resumable connection to dest through the first of
+// relays that can relay it. When the circuit breaks, the connection is resumed
+// through the other relays, and the same relay last, for up to ResumeTimeout.
+// Both ends need OptResumable.
+func (r *Relay) DialResumable(ctx context.Context, relays []peer.AddrInfo, dest peer.AddrInfo) (*ResumableConn, error) {
+	if !r.resumable {
+		return nil, fmt.Errorf("can't dial %s: resumable circuits are disabled", dest.ID)
+	}
+	if len(relays) == 0 {
+		return nil, fmt.Errorf("no relay to dial %s through", dest.ID)
+	}
+
+	token := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	var err error
+	for i, relay := range relays {
+		var c *Conn
+		c, err = r.dialChain(ctx, []peer.AddrInfo{relay}, dest, token, false)
+		if err != nil {
+			log.Debugf("error dialing %s through %s: %s", dest.ID.Pretty(), relay.ID.Pretty(), err)
+			continue
+		}
+
+		// a destination ignoring the token would take the frames for
+		// data: nothing is written before it confirms
+		br := bufio.NewReader(c)
+		if err := awaitHello(c, br); err != nil {
+			c.Reset()
+			return nil, err
+		}
+
+		rc := newResumableConn(r, dest.ID, token)
+		next := i
+		rc.redial = func(ctx context.Context) (*Conn, error) {
+			var err error
+			for range relays {
+				next = (next + 1) % len(relays)
+				var c *Conn
+				c, err = r.dialChain(ctx, []peer.AddrInfo{relays[next]}, dest, token, true)
+				if err == nil || isResumeRefused(err) {
+					return c, err
+				}
+			}
+			return nil, err
+		}
+		rc.attach(c, br)
+		return rc, nil
+	}
+
+	return nil, err
+}
+
+// awaitHello waits for the destination of a new resumable connection to
+// confirm it speaks the protocol.
+func awaitHello(c *Conn, br *bufio.Reader) error {
+	c.SetReadDeadline(time.Now().Add(StopHandshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	typ, _, err := readFrameHeader(br)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrResumeUnsupported, err)
+	}
+	if typ != frameHello {
+		return fmt.Errorf("%w: got frame type %d", ErrResumeUnsupported, typ)
+	}
+	return nil
+}
+
+func isResumeRefused(err error) bool {
+	rerr, ok := err.(RelayError)
+	return ok && rerr.Code == pb.CircuitRelay_STOP_RESUME_REFUSED
+}
+
+// addSession registers the session of a resumable connection accepted from
+// remote.
+func (r *Relay) addSession(remote peer.AddrInfo, token []byte) *ResumableConn {
+	rc := newResumableConn(r, remote.ID, token)
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.sessions[rc.key] = rc
+	return rc
+}
+
+func (r *Relay) rmSession(rc *ResumableConn) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.sessions[rc.key] == rc {
+		delete(r.sessions, rc.key)
+	}
+}
+
+// resumeSession resumes an accepted resumable connection over c.
+func (r *Relay) resumeSession(c *Conn, token []byte) {
+	r.mx.Lock()
+	rc, ok := r.sessions[sessionKey{peer: c.remote.ID, token: string(token)}]
+	r.mx.Unlock()
+
+	if !ok {
+		r.handleError(c.stream, pb.CircuitRelay_STOP_RESUME_REFUSED)
+		return
+	}
+
+	err := r.writeResponse(c.stream, pb.CircuitRelay_SUCCESS)
+	if err != nil {
+		log.Debugf("error writing relay response: %s", err.Error())
+		c.stream.Reset()
+		return
+	}
+
+	br := bufio.NewReader(c)
+	if err := rc.authenticate(c, br); err != nil {
+		log.Warnf("refusing to resume relay connection from %s: %s", c.remote.ID, err)
+		c.Reset()
+		return
+	}
+
+	log.Infof("resumed relay connection from %s", c.remote.ID)
+
+	c.tagHop()
+	c.startKeepalive()
+	rc.attach(c, br)
+}
+
+// attach makes c the circuit of the connection, replacing the current one.
+// Reads from c go through br, if set.
+func (rc *ResumableConn) attach(c *Conn, br *bufio.Reader) {
+	rc.mx.Lock()
+	if rc.err != nil || rc.finished {
+		rc.mx.Unlock()
+		c.Reset()
+		return
+	}
+	old := rc.conn
+	rc.gen++
+	gen := rc.gen
+	rc.conn, rc.last, rc.ready = c, c, false
+	if rc.expiry != nil {
+		rc.expiry.Stop()
+		rc.expiry = nil
+	}
+	rc.mx.Unlock()
+
+	if old != nil {
+		old.Reset()
+	}
+
+	if br == nil {
+		br = bufio.NewReader(c)
+	}
+	go rc.run(c, br, gen)
+}
+
+func (rc *ResumableConn) run(c *Conn, br *bufio.Reader, gen int) {
+	err := rc.handshake(c, br, gen)
+	for err == nil {
+		err = rc.readFrame(c, br, gen)
+	}
+	rc.broken(gen, err)
+}
+
+// handshake resumes the stream over a new circuit: both ends tell each other
+// how much they consumed, and retransmit the rest.
+func (rc *ResumableConn) handshake(c *Conn, br *bufio.Reader, gen int) error {
+	rc.wmx.Lock()
+	defer rc.wmx.Unlock()
+
+	rc.mx.Lock()
+	offset := rc.resumeOffset()
+	rc.mx.Unlock()
+
+	if err := writeFrame(c, frameAck, offset, nil); err != nil {
+		return err
+	}
+
+	c.SetReadDeadline(time.Now().Add(StopHandshakeTimeout))
+	typ, v, err := readFrameHeader(br)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if typ != frameAck {
+		return rc.protocolError("expected an ack frame, got frame type %d", typ)
+	}
+
+	rc.mx.Lock()
+	if gen != rc.gen {
+		rc.mx.Unlock()
+		return net.ErrClosed
+	}
+	if v < rc.sendBase || v > rc.sendBase+uint64(len(rc.sendBuf)) {
+		rc.mx.Unlock()
+		return rc.protocolError("can't resume at offset %d, buffered data starts at %d", v, rc.sendBase)
+	}
+	rc.forget(v)
+	data := append([]byte(nil), rc.sendBuf...)
+	sent := rc.sendBase + uint64(len(rc.sendBuf))
+	closed := rc.localClosed
+	rc.ready = true
+	rc.cond.Broadcast()
+	rc.mx.Unlock()
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if err := writeFrame(c, frameData, uint64(n), data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	if closed {
+		return writeFrame(c, frameClose, sent, nil)
+	}
+	return nil
+}
+
+func (rc *ResumableConn) readFrame(c *Conn, br *bufio.Reader, gen int) error {
+	typ, v, err := readFrameHeader(br)
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case frameData:
+		if v > maxFrameSize {
+			return rc.protocolError("data frame too large: %d bytes", v)
+		}
+		data := make([]byte, v)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+
+		rc.mx.Lock()
+		if gen != rc.gen {
+			rc.mx.Unlock()
+			return net.ErrClosed
+		}
+		// the peer may only send as much data as it buffers until it is
+		// acknowledged
+		if unacked := rc.received + v - rc.acked; unacked > uint64(ResumeBufferSize) {
+			rc.mx.Unlock()
+			return rc.protocolError("%d bytes received unacknowledged, beyond the buffer size of %d", unacked, ResumeBufferSize)
+		}
+		rc.received += v
+		if rc.readClosed {
+			rc.consumed += v
+		} else {
+			rc.recvBuf = append(rc.recvBuf, data...)
+		}
+		rc.cond.Broadcast()
+		rc.mx.Unlock()
+
+		rc.requestAck()
+
+	case frameAck:
+		rc.mx.Lock()
+		if v > rc.sendBase+uint64(len(rc.sendBuf)) {
+			rc.mx.Unlock()
+			return rc.protocolError("ack of %d bytes beyond the %d sent", v, rc.sendBase+uint64(len(rc.sendBuf)))
+		}
+		rc.forget(v)
+		rc.cond.Broadcast()
+		done, fc := rc.finish()
+		rc.mx.Unlock()
+
+		if done {
+			rc.close(fc)
+		}
+
+	case frameClose:
+		rc.mx.Lock()
+		if v != rc.received {
+			rc.mx.Unlock()
+			return rc.protocolError("peer closed after %d bytes, received %d", v, rc.received)
+		}
+		rc.remoteClosed = true
+		rc.cond.Broadcast()
+		done, fc := rc.finish()
+		rc.mx.Unlock()
+
+		if done {
+			rc.close(fc)
+		}
+
+	case frameReset:
+		rc.fail(errSessionReset)
+		return errSessionReset
+
+	default:
+		return rc.protocolError("unknown frame type %d", typ)
+	}
+
+	return nil
+}
+
+// resumeOffset returns the offset the peer resumes sending at: the received
+// data not read yet is dropped and retransmitted, so that the peer never has
+// more than ResumeBufferSize unacknowledged in flight, however many times the
+// connection resumes. Must be called with the lock held.
+func (rc *ResumableConn) resumeOffset() uint64 {
+	if rc.received > rc.consumed {
+		rc.recvBuf = nil
+		rc.received = rc.consumed
+		// the peer closes again after retransmitting
+		rc.remoteClosed = false
+	}
+	rc.acked = rc.consumed
+	return rc.consumed
+}
+
+// forget drops the buffered data up to offset v, which the peer received;
+// must be called with the lock held.
+func (rc *ResumableConn) forget(v uint64) {
+	if v > rc.sendBase {
+		rc.sendBuf = rc.sendBuf[v-rc.sendBase:]
+		rc.sendBase = v
+	}
+}
+
+func (rc *ResumableConn) ackLoop() {
+	for {
+		select {
+		case <-rc.ackCh:
+			rc.ack()
+		case <-rc.done:
+			return
+		}
+	}
+}
+
+func (rc *ResumableConn) requestAck() {
+	select {
+	case rc.ackCh <- struct{}{}:
+	default:
+	}
+}
+
+// ack acknowledges the data read by the application, once the receive buffer
+// is drained or a quarter of the buffer size was read since the last ack.
+func (rc *ResumableConn) ack() {
+	rc.mx.Lock()
+	if rc.consumed <= rc.acked || rc.conn == nil || !rc.ready ||
+		(len(rc.recvBuf) > 0 && rc.consumed-rc.acked < uint64(ResumeBufferSize/4)) {
+		rc.mx.Unlock()
+		return
+	}
+	c, gen := rc.conn, rc.gen
+	rc.mx.Unlock()
+
+	rc.wmx.Lock()
+	defer rc.wmx.Unlock()
+
+	rc.mx.Lock()
+	if gen != rc.gen || rc.consumed <= rc.acked {
+		rc.mx.Unlock()
+		return
+	}
+	v := rc.consumed
+	rc.acked = v
+	done, fc := rc.finish()
+	rc.mx.Unlock()
+
+	if err := writeFrame(c, frameAck, v, nil); err != nil {
+		rc.broken(gen, err)
+		return
+	}
+	if done {
+		rc.close(fc)
+	}
+}
+
+// finish marks the connection finished once both ends closed it for writing
+// and acknowledged all the data; it must be called with the lock held, and
+// the circuit it returns closed with close.
+func (rc *ResumableConn) finish() (bool, *Conn) {
+	if rc.finished || rc.err != nil || !rc.localClosed || !rc.remoteClosed ||
+		len(rc.sendBuf) > 0 || rc.acked < rc.received {
+		return false, nil
+	}
+
+	rc.finished = true
+	c := rc.conn
+	rc.conn, rc.ready = nil, false
+	rc.gen++
+	if rc.expiry != nil {
+		rc.expiry.Stop()
+	}
+	rc.cond.Broadcast()
+	return true, c
+}
+
+func (rc *ResumableConn) close(c *Conn) {
+	rc.closeDone.Do(func() { close(rc.done) })
+	rc.relay.rmSession(rc)
+	if c != nil {
+		c.Close()
+	}
+}
+
+// broken handles the failure of the circuit of generation gen: the dialer
+// resumes the connection, and the accepting end waits for it.
+func (rc *ResumableConn) broken(gen int, err error) {
+	rc.mx.Lock()
+	if gen != rc.gen || rc.conn == nil || rc.err != nil || rc.finished {
+		rc.mx.Unlock()
+		return
+	}
+
+	log.Debugf("relayed connection to %s broke: %s", rc.remote.Pretty(), err)
+
+	c := rc.conn
+	rc.conn, rc.ready = nil, false
+
+	resume := false
+	if rc.redial != nil {
+		resume = !rc.resuming
+		rc.resuming = true
+	} else {
+		rc.expiry = time.AfterFunc(ResumeTimeout, func() { rc.expire(gen) })
+	}
+	rc.mx.Unlock()
+
+	c.Reset()
+
+	if resume {
+		go rc.resume()
+	}
+}
+
+func (rc *ResumableConn) expire(gen int) {
+	rc.mx.Lock()
+	expired := gen == rc.gen && rc.conn == nil
+	rc.mx.Unlock()
+
+	if expired {
+		rc.fail(errResumeTimeout)
+	}
+}
+
+func (rc *ResumableConn) resume() {
+	ctx, cancel := context.WithTimeout(rc.relay.ctx, ResumeTimeout)
+	defer cancel()
+
+	backoff := 100 * time.Millisecond
+	for {
+		rc.mx.Lock()
+		if rc.conn != nil || rc.err != nil || rc.finished {
+			rc.resuming = false
+			rc.mx.Unlock()
+			return
+		}
+		rc.mx.Unlock()
+
+		c, err := rc.redial(ctx)
+		switch {
+		case err == nil:
+			br := bufio.NewReader(c)
+			if err = rc.authenticate(c, br); err == nil {
+				rc.attach(c, br)
+				continue
+			}
+			c.Reset()
+		case isResumeRefused(err):
+			rc.fail(err)
+			return
+		}
+
+		log.Debugf("error resuming relayed connection to %s: %s", rc.remote.Pretty(), err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			rc.fail(errResumeTimeout)
+			return
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+func (rc *ResumableConn) protocolError(format string, args ...interface{}) error {
+	err := fmt.Errorf("resumable connection protocol error: "+format, args...)
+	rc.fail(err)
+	return err
+}
+
+// fail terminates the connection with err.
+func (rc *ResumableConn) fail(err error) {
+	rc.mx.Lock()
+	if rc.err != nil {
+		rc.mx.Unlock()
+		return
+	}
+	rc.err = err
+	c := rc.conn
+	rc.conn, rc.ready = nil, false
+	rc.gen++
+	if rc.expiry != nil {
+		rc.expiry.Stop()
+	}
+	rc.cond.Broadcast()
+	rc.mx.Unlock()
+
+	rc.closeDone.Do(func() { close(rc.done) })
+	rc.relay.rmSession(rc)
+	if c != nil {
+		c.Reset()
+	}
+}
+
+// wait blocks until the state of the connection changes or the deadline
+// passes; it must be called with the lock held.
+func (rc *ResumableConn) wait(deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	rc.cond.Wait()
+	return nil
+}
+
+func (rc *ResumableConn) Read(b []byte) (int, error) {
+	rc.mx.Lock()
+	for {
+		if len(rc.recvBuf) > 0 {
+			n := copy(b, rc.recvBuf)
+			rc.recvBuf = rc.recvBuf[n:]
+			rc.consumed += uint64(n)
+			rc.mx.Unlock()
+
+			rc.requestAck()
+			return n, nil
+		}
+
+		var err error
+		switch {
+		case rc.readClosed:
+			err = net.ErrClosed
+		case rc.remoteClosed:
+			err = io.EOF
+		case rc.err != nil:
+			err = rc.err
+		default:
+			err = rc.wait(rc.rdl)
+		}
+		if err != nil {
+			rc.mx.Unlock()
+			return 0, err
+		}
+	}
+}
+
+func (rc *ResumableConn) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		n, err := rc.write(b)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// write buffers and sends up to one frame of b.
+func (rc *ResumableConn) write(b []byte) (int, error) {
+	// wait for buffer space before acquiring the write lock, which acks need
+	rc.mx.Lock()
+	for {
+		err := rc.writeErr()
+		if err == nil && len(rc.sendBuf) < ResumeBufferSize {
+			break
+		}
+		if err == nil {
+			err = rc.wait(rc.wdl)
+		}
+		if err != nil {
+			rc.mx.Unlock()
+			return 0, err
+		}
+	}
+	rc.mx.Unlock()
+
+	rc.wmx.Lock()
+	defer rc.wmx.Unlock()
+
+	rc.mx.Lock()
+	if err := rc.writeErr(); err != nil {
+		rc.mx.Unlock()
+		return 0, err
+	}
+	n := ResumeBufferSize - len(rc.sendBuf)
+	if n > len(b) {
+		n = len(b)
+	}
+	if n > maxFrameSize {
+		n = maxFrameSize
+	}
+	if n <= 0 {
+		rc.mx.Unlock()
+		return 0, nil
+	}
+	rc.sendBuf = append(rc.sendBuf, b[:n]...)
+	c, gen, ready := rc.conn, rc.gen, rc.ready
+	rc.mx.Unlock()
+
+	// while the connection is broken, the data is sent when resuming it
+	if c != nil && ready {
+		if err := writeFrame(c, frameData, uint64(n), b[:n]); err != nil {
+			rc.broken(gen, err)
+		}
+	}
+	return n, nil
+}
+
+// must be called with the lock held.
+func (rc *ResumableConn) writeErr() error {
+	switch {
+	case rc.localClosed:
+		return net.ErrClosed
+	case rc.err != nil:
+		return rc.err
+	}
+	return nil
+}
+
+// CloseWrite closes the connection for writing; the remote peer reads EOF
+// once it has read the data written before.
+func (rc *ResumableConn) CloseWrite() error {
+	rc.wmx.Lock()
+	defer rc.wmx.Unlock()
+
+	rc.mx.Lock()
+	if rc.localClosed {
+		rc.mx.Unlock()
+		return nil
+	}
+	if rc.err != nil {
+		rc.mx.Unlock()
+		return rc.err
+	}
+	rc.localClosed = true
+	rc.cond.Broadcast()
+	c, gen, ready := rc.conn, rc.gen, rc.ready
+	sent := rc.sendBase + uint64(len(rc.sendBuf))
+	done, fc := rc.finish()
+	rc.mx.Unlock()
+
+	if c != nil && ready && !done {
+		if err := writeFrame(c, frameClose, sent, nil); err != nil {
+			rc.broken(gen, err)
+		}
+	}
+	if done {
+		rc.close(fc)
+	}
+	return nil
+}
+
+// Close closes the connection gracefully: the data written before is still
+// delivered, and the remote peer reads EOF after it. Data received from then
+// on is discarded.
+func (rc *ResumableConn) Close() error {
+	if err := rc.CloseWrite(); err != nil && err != net.ErrClosed {
+		return err
+	}
+
+	rc.mx.Lock()
+	rc.readClosed = true
+	rc.consumed += uint64(len(rc.recvBuf))
+	rc.recvBuf = nil
+	rc.cond.Broadcast()
+	rc.mx.Unlock()
+
+	rc.requestAck()
+	return nil
+}
+
+// Reset aborts the connection; it won't be resumed.
+func (rc *ResumableConn) Reset() error {
+	rc.wmx.Lock()
+	rc.mx.Lock()
+	c, ready := rc.conn, rc.ready
+	rc.conn, rc.ready = nil, false
+	rc.mx.Unlock()
+	if c != nil && ready {
+		writeFrame(c, frameReset, 0, nil)
+	}
+	rc.wmx.Unlock()
+
+	rc.fail(net.ErrClosed)
+	if c != nil {
+		c.Close()
+	}
+	return nil
+}
+
+func (rc *ResumableConn) SetDeadline(t time.Time) error {
+	rc.SetReadDeadline(t)
+	return rc.SetWriteDeadline(t)
+}
+
+func (rc *ResumableConn) SetReadDeadline(t time.Time) error {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	rc.rdl = t
+	rc.rtimer = rc.resetTimer(rc.rtimer, t)
+	return nil
+}
+
+func (rc *ResumableConn) SetWriteDeadline(t time.Time) error {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	rc.wdl = t
+	rc.wtimer = rc.resetTimer(rc.wtimer, t)
+	return nil
+}
+
+// resetTimer replaces timer with one waking up waiters at deadline t; it must
+// be called with the lock held.
+func (rc *ResumableConn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	rc.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		rc.mx.Lock()
+		defer rc.mx.Unlock()
+		rc.cond.Broadcast()
+	})
+}
+
+// current returns the latest circuit of the connection.
+func (rc *ResumableConn) current() *Conn {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	return rc.last
+}
+
+// LocalMultiaddr returns the local address of the current circuit of the
+// connection.
+func (rc *ResumableConn) LocalMultiaddr() ma.Multiaddr {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	return rc.last.LocalMultiaddr()
+}
+
+// RemoteMultiaddr returns the remote address of the current circuit of the
+// connection, which changes when it is resumed through another relay.
+func (rc *ResumableConn) RemoteMultiaddr() ma.Multiaddr {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	return rc.last.RemoteMultiaddr()
+}
+
+func (rc *ResumableConn) LocalAddr() net.Addr {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	return rc.last.LocalAddr()
+}
+
+func (rc *ResumableConn) RemoteAddr() net.Addr {
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	return rc.last.RemoteAddr()
+}
+
+func writeFrame(w io.Writer, typ byte, v uint64, payload []byte) error {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(payload))
+	buf[0] = typ
+	n := binary.PutUvarint(buf[1:], v)
+	buf = append(buf[:1+n], payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrameHeader(br *bufio.Reader) (byte, uint64, error) {
+	typ, err := br.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	v, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, 0, err
+	}
+	return typ, v, nil
+}
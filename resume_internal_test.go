@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestResumableConnReceiveLimit(t *testing.T) {
+	size := ResumeBufferSize
+	ResumeBufferSize = 1024
+	defer func() { ResumeBufferSize = size }()
+
+	r := newKeyRelay(t)
+	rc := newTestSession(t, r, r.self, []byte("0123456789abcdef"))
+
+	// the peer sends more than it may before being acknowledged
+	var frames bytes.Buffer
+	payload := make([]byte, 600)
+	for i := 0; i < 2; i++ {
+		if err := writeFrame(&frames, frameData, uint64(len(payload)), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	br := bufio.NewReader(&frames)
+
+	if err := rc.readFrame(nil, br, rc.gen); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.readFrame(nil, br, rc.gen); err == nil {
+		t.Fatal("expected data beyond the buffer size to be refused")
+	}
+
+	// the data received before is still delivered
+	if n, err := rc.Read(make([]byte, 1024)); n != len(payload) || err != nil {
+		t.Fatalf("expected to read %d bytes, got %d (%v)", len(payload), n, err)
+	}
+	if _, err := rc.Read(make([]byte, 1024)); err == nil {
+		t.Fatal("expected the connection to fail")
+	}
+}
+
+func TestResumableConnReceiveLimitAfterResume(t *testing.T) {
+	size := ResumeBufferSize
+	ResumeBufferSize = 1024
+	defer func() { ResumeBufferSize = size }()
+
+	r := newKeyRelay(t)
+	rc := newTestSession(t, r, r.self, []byte("0123456789abcdef"))
+
+	var frames bytes.Buffer
+	payload := make([]byte, 600)
+	for i := 0; i < 3; i++ {
+		if err := writeFrame(&frames, frameData, uint64(len(payload)), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	br := bufio.NewReader(&frames)
+
+	if err := rc.readFrame(nil, br, rc.gen); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unread data is retransmitted after resuming, not acknowledged
+	rc.mx.Lock()
+	offset := rc.resumeOffset()
+	rc.mx.Unlock()
+	if offset != 0 {
+		t.Fatalf("expected to resume at offset 0, got %d", offset)
+	}
+
+	if err := rc.readFrame(nil, br, rc.gen); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.readFrame(nil, br, rc.gen); err == nil {
+		t.Fatal("expected data beyond the buffer size to be refused after resuming")
+	}
+}
@@ -0,0 +1,181 @@
+package relay_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+func dialResumable(t *testing.T, nw *relaytest.Network) (*ResumableConn, *ResumableConn) {
+	accept := nw.Nodes[3].Accept()
+
+	relays := []peer.AddrInfo{nw.Nodes[1].Info(), nw.Nodes[2].Info()}
+	c, err := nw.Nodes[0].Relay.DialResumable(context.Background(), relays, peer.AddrInfo{ID: nw.Nodes[3].Host.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Reset() })
+
+	dc := accept()
+	rc, ok := dc.(*ResumableConn)
+	if !ok {
+		t.Fatalf("expected a resumable connection, got %T", dc)
+	}
+	t.Cleanup(func() { rc.Reset() })
+
+	c.SetDeadline(time.Now().Add(20 * time.Second))
+	rc.SetDeadline(time.Now().Add(20 * time.Second))
+
+	return c, rc
+}
+
+func testResumableConn(t *testing.T, breakCircuit func(nw *relaytest.Network)) {
+	nw := resumableTopology(t, relaytest.Resumable)
+	c, dc := dialResumable(t, nw)
+
+	relay1 := nw.Nodes[1].Host.ID().Pretty()
+	if !strings.Contains(c.RemoteMultiaddr().String(), relay1) {
+		t.Fatalf("expected to go through the first relay, got %s", c.RemoteMultiaddr())
+	}
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	go func() {
+		if _, err := c.Write(data); err != nil {
+			t.Error(err)
+		}
+		c.CloseWrite()
+	}()
+
+	// break the circuit half way through
+	if _, err := io.ReadFull(dc, make([]byte, len(data)/2)); err != nil {
+		t.Fatal(err)
+	}
+	breakCircuit(nw)
+
+	rest, err := ioutil.ReadAll(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, data[len(data)/2:]) {
+		t.Fatalf("expected the %d remaining bytes, got %d bytes", len(data)/2, len(rest))
+	}
+
+	relay2 := nw.Nodes[2].Host.ID().Pretty()
+	if !strings.Contains(c.RemoteMultiaddr().String(), relay2) {
+		t.Fatalf("expected to be resumed through the second relay, got %s", c.RemoteMultiaddr())
+	}
+	if stat, ok := GetConnStat(c); !ok || stat.Relay != nw.Nodes[2].Host.ID() {
+		t.Fatalf("expected the stat of the circuit through the second relay, got %v", stat)
+	}
+
+	// the other direction still works
+	msg := []byte("resumed!")
+	if _, err := dc.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	dc.Close()
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("expected %q, got %q", msg, got)
+	}
+}
+
+func TestResumableConnRelayCrash(t *testing.T) {
+	testResumableConn(t, func(nw *relaytest.Network) {
+		nw.Crash(1)
+	})
+}
+
+func TestResumableConnLinkDrop(t *testing.T) {
+	testResumableConn(t, func(nw *relaytest.Network) {
+		nw.Link(1, 3).Drop()
+	})
+}
+
+func TestResumableConnReset(t *testing.T) {
+	nw := resumableTopology(t, relaytest.Resumable)
+	c, dc := dialResumable(t, nw)
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(dc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	dc.Reset()
+	if _, err := ioutil.ReadAll(c); err == nil {
+		t.Fatal("expected reading from a reset connection to fail")
+	}
+}
+
+func TestResumableConnRefused(t *testing.T) {
+	nw := resumableTopology(t, relaytest.Client)
+
+	relays := []peer.AddrInfo{nw.Nodes[1].Info()}
+	_, err := nw.Nodes[0].Relay.DialResumable(context.Background(), relays, peer.AddrInfo{ID: nw.Nodes[3].Host.ID()})
+	rerr, ok := err.(RelayError)
+	if !ok || rerr.Code != pb.CircuitRelay_STOP_RESUME_REFUSED {
+		t.Fatalf("expected STOP_RESUME_REFUSED, got %v", err)
+	}
+}
+
+func TestResumableConnUnsupported(t *testing.T) {
+	timeout := StopHandshakeTimeout
+	StopHandshakeTimeout = 200 * time.Millisecond
+	defer func() { StopHandshakeTimeout = timeout }()
+
+	nw := resumableTopology(t, relaytest.Client)
+
+	// a destination that ignores the session token and accepts the circuit
+	received := make(chan int, 1)
+	nw.Nodes[3].Host.SetStreamHandler(ProtoID, func(s network.Stream) {
+		defer s.Reset()
+		if err := protoio.NewDelimitedReader(s, 4096).ReadMsg(new(pb.CircuitRelay)); err != nil {
+			received <- -1
+			return
+		}
+		resp := &pb.CircuitRelay{Type: pb.CircuitRelay_STATUS.Enum(), Code: pb.CircuitRelay_SUCCESS.Enum()}
+		if err := protoio.NewDelimitedWriter(s).WriteMsg(resp); err != nil {
+			received <- -1
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, s)
+		received <- int(n)
+	})
+
+	relays := []peer.AddrInfo{nw.Nodes[1].Info()}
+	_, err := nw.Nodes[0].Relay.DialResumable(context.Background(), relays, peer.AddrInfo{ID: nw.Nodes[3].Host.ID()})
+	if !errors.Is(err, ErrResumeUnsupported) {
+		t.Fatalf("expected ErrResumeUnsupported, got %v", err)
+	}
+
+	// the destination doesn't take frames for data
+	select {
+	case n := <-received:
+		if n != 0 {
+			t.Fatalf("expected the destination to receive nothing, got %d bytes", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the circuit to be reset")
+	}
+}
@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/multiformats/go-varint"
+)
+
+const (
+	resumeNonceSize = 32
+	resumeSigPrefix = "libp2p-circuit-resume:"
+)
+
+var errResumeAuth = errors.New("peer failed to authenticate resumed relayed connection")
+
+// authenticate authenticates the peer of a circuit resuming the session over
+// c, whose reads go through br.
+//
+// Session tokens travel in the clear through the relays, which could replay
+// them to take over the sessions they relayed. Before a circuit resumes a
+// session, both ends prove they hold the private key of their peer ID by
+// signing a fresh nonce of the other end along with the token and both peer
+// IDs, which relays can neither forge nor replay.
+func (rc *ResumableConn) authenticate(c net.Conn, br *bufio.Reader) error {
+	sk := rc.relay.host.Peerstore().PrivKey(rc.relay.self)
+	if sk == nil {
+		return fmt.Errorf("no private key for %s", rc.relay.self)
+	}
+	pk, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, resumeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	c.SetReadDeadline(time.Now().Add(StopHandshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	if err := writeFrame(c, frameNonce, uint64(len(nonce)), nonce); err != nil {
+		return err
+	}
+	peerNonce, err := readPayloadFrame(br, frameNonce, resumeNonceSize)
+	if err != nil {
+		return err
+	}
+	if len(peerNonce) != resumeNonceSize {
+		return errResumeAuth
+	}
+
+	sig, err := sk.Sign(resumeSignedData(rc.key.token, rc.relay.self, rc.remote, peerNonce))
+	if err != nil {
+		return err
+	}
+	payload := append(varint.ToUvarint(uint64(len(pk))), pk...)
+	payload = append(payload, sig...)
+	if err := writeFrame(c, frameAuth, uint64(len(payload)), payload); err != nil {
+		return err
+	}
+
+	payload, err = readPayloadFrame(br, frameAuth, maxFrameSize)
+	if err != nil {
+		return err
+	}
+	klen, n, err := varint.FromUvarint(payload)
+	if err != nil || klen > uint64(len(payload)-n) {
+		return errResumeAuth
+	}
+	peerKey, err := crypto.UnmarshalPublicKey(payload[n : n+int(klen)])
+	if err != nil {
+		return errResumeAuth
+	}
+	if !rc.remote.MatchesPublicKey(peerKey) {
+		return errResumeAuth
+	}
+	ok, err := peerKey.Verify(resumeSignedData(rc.key.token, rc.remote, rc.relay.self, nonce), payload[n+int(klen):])
+	if err != nil || !ok {
+		return errResumeAuth
+	}
+	return nil
+}
+
+// resumeSignedData returns the data signer signs for verifier to resume the
+// session of token, given the nonce of verifier.
+func resumeSignedData(token string, signer, verifier peer.ID, nonce []byte) []byte {
+	b := []byte(resumeSigPrefix)
+	for _, f := range [][]byte{[]byte(token), []byte(signer), []byte(verifier), nonce} {
+		b = append(b, varint.ToUvarint(uint64(len(f)))...)
+		b = append(b, f...)
+	}
+	return b
+}
+
+// readPayloadFrame reads a frame of type typ, with a payload of up to max
+// bytes.
+func readPayloadFrame(br *bufio.Reader, typ byte, max int) ([]byte, error) {
+	t, v, err := readFrameHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if t != typ || v > uint64(max) {
+		return nil, errResumeAuth
+	}
+	payload := make([]byte, v)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+)
+
+// keyHost is a host with an identity and nothing else.
+type keyHost struct {
+	host.Host
+	id peer.ID
+	ps peerstore.Peerstore
+}
+
+func (h *keyHost) ID() peer.ID                    { return h.id }
+func (h *keyHost) Peerstore() peerstore.Peerstore { return h.ps }
+
+func newKeyRelay(t *testing.T) *Relay {
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.AddPrivKey(id, sk)
+
+	r := newRelay(&keyHost{id: id, ps: ps}, nil)
+	t.Cleanup(func() {
+		r.ctxCancel()
+		ps.Close()
+	})
+	return r
+}
+
+func newTestSession(t *testing.T, r *Relay, remote peer.ID, token []byte) *ResumableConn {
+	rc := newResumableConn(r, remote, token)
+	t.Cleanup(func() { rc.fail(net.ErrClosed) })
+	return rc
+}
+
+// connPair returns the two ends of a TCP connection, whose writes, unlike
+// those of net.Pipe, are buffered as those of streams.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// recordingConn records the data written to it.
+type recordingConn struct {
+	net.Conn
+	sent bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.sent.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestResumeAuthentication(t *testing.T) {
+	a, b, relay := newKeyRelay(t), newKeyRelay(t), newKeyRelay(t)
+	token := []byte("0123456789abcdef")
+
+	ca, cb := connPair(t)
+	rec := &recordingConn{Conn: ca}
+
+	errs := make(chan error, 1)
+	sa := newTestSession(t, a, b.self, token)
+	go func() {
+		errs <- sa.authenticate(rec, bufio.NewReader(ca))
+	}()
+	if err := newTestSession(t, b, a.self, token).authenticate(cb, bufio.NewReader(cb)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// a relay that saw the token and the authentication of the dialer can't
+	// replay them to take over the session
+	replay, cb := connPair(t)
+	go func() {
+		replay.Write(rec.sent.Bytes())
+		io.Copy(io.Discard, replay)
+	}()
+	if err := newTestSession(t, b, a.self, token).authenticate(cb, bufio.NewReader(cb)); err != errResumeAuth {
+		t.Fatalf("expected a replayed authentication to fail, got %v", err)
+	}
+
+	// nor authenticate with its own key
+	forge, cb := connPair(t)
+	sr := newTestSession(t, relay, b.self, token)
+	go func() {
+		sr.authenticate(forge, bufio.NewReader(forge))
+		io.Copy(io.Discard, forge)
+	}()
+	if err := newTestSession(t, b, a.self, token).authenticate(cb, bufio.NewReader(cb)); err != errResumeAuth {
+		t.Fatalf("expected the relay to fail to authenticate, got %v", err)
+	}
+}
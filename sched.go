@@ -0,0 +1,261 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// period over which the bandwidth budget is distributed
+const schedTick = 10 * time.Millisecond
+
+type schedWaiter struct {
+	want, granted int
+	ready         chan struct{}
+}
+
+// scheduler shares a bandwidth budget between the circuits of a hop relay.
+// Every tick, the budget is split between the peers with pending writes in
+// proportion to their weights, and each peer's share is split evenly
+// between its waiting circuits, so that bulk transfers can't starve
+// interactive circuits.
+type scheduler struct {
+	ctx context.Context
+
+	mx      sync.Mutex
+	rate    int
+	weights map[peer.ID]int
+	queues  map[peer.ID][]*schedWaiter
+	order   []peer.ID
+	running bool
+}
+
+func newScheduler(ctx context.Context) *scheduler {
+	return &scheduler{
+		ctx:     ctx,
+		weights: make(map[peer.ID]int),
+		queues:  make(map[peer.ID][]*schedWaiter),
+	}
+}
+
+func (s *scheduler) limited() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.rate > 0
+}
+
+func (s *scheduler) setRate(rate int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.rate = rate
+}
+
+func (s *scheduler) setWeight(p peer.ID, weight int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if weight <= 0 {
+		delete(s.weights, p)
+	} else {
+		s.weights[p] = weight
+	}
+}
+
+// must be called with the lock held.
+func (s *scheduler) weight(p peer.ID) int {
+	if w, ok := s.weights[p]; ok {
+		return w
+	}
+	return 1
+}
+
+// acquire blocks until the circuit is granted between 1 and want bytes of
+// the budget for peer p, and returns the number of bytes granted.
+func (s *scheduler) acquire(p peer.ID, want int) int {
+	s.mx.Lock()
+	if s.rate <= 0 || s.ctx.Err() != nil {
+		s.mx.Unlock()
+		return want
+	}
+
+	w := s.enqueue(p, want)
+	if !s.running {
+		s.running = true
+		go s.loop()
+	}
+	s.mx.Unlock()
+
+	<-w.ready
+	return w.granted
+}
+
+// enqueue adds a circuit of p waiting for want bytes; it must be called with
+// the lock held.
+func (s *scheduler) enqueue(p peer.ID, want int) *schedWaiter {
+	w := &schedWaiter{want: want, ready: make(chan struct{})}
+	if len(s.queues[p]) == 0 {
+		s.order = append(s.order, p)
+	}
+	s.queues[p] = append(s.queues[p], w)
+	return w
+}
+
+func (s *scheduler) loop() {
+	ticker := time.NewTicker(schedTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mx.Lock()
+			s.tick()
+		case <-s.ctx.Done():
+			s.mx.Lock()
+			for _, q := range s.queues {
+				for _, w := range q {
+					w.granted = w.want
+				}
+			}
+			s.release()
+		}
+
+		if len(s.order) == 0 {
+			s.running = false
+			s.mx.Unlock()
+			return
+		}
+		s.mx.Unlock()
+	}
+}
+
+// tick distributes one tick's worth of the budget; it must be called with
+// the lock held.
+func (s *scheduler) tick() {
+	budget := int(int64(s.rate) * int64(schedTick) / int64(time.Second))
+	if budget < 1 {
+		budget = 1
+	}
+
+	// rotate, so that no peer is always served first when the budget is
+	// smaller than the number of waiting circuits.
+	if len(s.order) > 1 {
+		s.order = append(s.order[1:], s.order[0])
+	}
+
+	for budget > 0 {
+		total := 0
+		for _, p := range s.order {
+			if s.pending(p) > 0 {
+				total += s.weight(p)
+			}
+		}
+		if total == 0 {
+			break
+		}
+
+		spent := 0
+		for _, p := range s.order {
+			n := s.pending(p)
+			if n == 0 {
+				continue
+			}
+
+			share := budget * s.weight(p) / total / n
+			if share < 1 {
+				share = 1
+			}
+
+			for _, w := range s.queues[p] {
+				grant := w.want - w.granted
+				if grant > share {
+					grant = share
+				}
+				if grant > budget-spent {
+					grant = budget - spent
+				}
+				w.granted += grant
+				spent += grant
+			}
+		}
+
+		if spent == 0 {
+			break
+		}
+		budget -= spent
+	}
+
+	s.release()
+}
+
+// pending returns the number of circuits of p that want more bytes.
+func (s *scheduler) pending(p peer.ID) int {
+	n := 0
+	for _, w := range s.queues[p] {
+		if w.granted < w.want {
+			n++
+		}
+	}
+	return n
+}
+
+// release wakes up the waiters that were granted bytes; it must be called
+// with the lock held.
+func (s *scheduler) release() {
+	order := s.order[:0]
+	for _, p := range s.order {
+		q := s.queues[p][:0]
+		for _, w := range s.queues[p] {
+			if w.granted > 0 {
+				close(w.ready)
+			} else {
+				q = append(q, w)
+			}
+		}
+
+		if len(q) == 0 {
+			delete(s.queues, p)
+		} else {
+			s.queues[p] = q
+			order = append(order, p)
+		}
+	}
+	s.order = order
+}
+
+// scheduledWriter writes through the scheduler on behalf of a peer.
+type scheduledWriter struct {
+	w     io.Writer
+	sched *scheduler
+	peer  peer.ID
+}
+
+func (sw *scheduledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := sw.sched.acquire(sw.peer, len(p)-written)
+		n, err := sw.w.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// SetHopBandwidthLimit sets the bandwidth, in bytes per second, shared by all
+// circuits relayed by this node. Circuits established while a limit is set
+// are scheduled fairly according to the peer weights. Zero, the default,
+// means unlimited.
+func (r *Relay) SetHopBandwidthLimit(bytesPerSecond int) {
+	r.sched.setRate(bytesPerSecond)
+}
+
+// SetPeerWeight sets the share of the hop bandwidth limit given to circuits
+// requested by a peer, relative to other peers. The default weight is 1; a
+// weight of zero restores the default.
+func (r *Relay) SetPeerWeight(p peer.ID, weight int) {
+	r.sched.setWeight(p, weight)
+}
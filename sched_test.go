@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// tickCircuits runs ticks of s by hand, with a circuit of each peer in
+// circuits that always wants want bytes, and returns the bytes granted to
+// each peer.
+func tickCircuits(s *scheduler, circuits []peer.ID, want, ticks int) map[peer.ID]int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.running = true
+
+	waiters := make([]*schedWaiter, len(circuits))
+	for i, p := range circuits {
+		waiters[i] = s.enqueue(p, want)
+	}
+
+	granted := make(map[peer.ID]int)
+	for i := 0; i < ticks; i++ {
+		s.tick()
+		for j, w := range waiters {
+			if w.granted > 0 {
+				granted[circuits[j]] += w.granted
+				waiters[j] = s.enqueue(circuits[j], want)
+			}
+		}
+	}
+	return granted
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	s := newScheduler(context.Background())
+	s.setRate(1 << 20)
+
+	bulk, chat := peer.ID("bulk"), peer.ID("chat")
+
+	// peers share the budget, not circuits: the bulk peer's four circuits
+	// get as much as the other peer's one
+	granted := tickCircuits(s, []peer.ID{bulk, bulk, bulk, bulk, chat}, 64*1024, 100)
+	ratio := float64(granted[bulk]) / float64(granted[chat])
+	if ratio < 0.9 || ratio > 1.1 {
+		t.Fatalf("expected a 1:1 share, got %d:%d", granted[bulk], granted[chat])
+	}
+
+	budget := int(int64(1<<20) * int64(schedTick) / int64(time.Second))
+	if total := granted[bulk] + granted[chat]; total > 100*budget {
+		t.Fatalf("scheduled %d bytes in 100 ticks of %d", total, budget)
+	}
+
+	// an interactive write is served in the next tick, behind saturating
+	// bulk transfers
+	s = newScheduler(context.Background())
+	s.setRate(1 << 20)
+	granted = tickCircuits(s, []peer.ID{bulk, bulk, bulk, bulk}, 64*1024, 1)
+	granted[chat] = tickCircuits(s, []peer.ID{chat}, 100, 1)[chat]
+	if granted[chat] != 100 {
+		t.Fatalf("expected the interactive write to be granted in the next tick, got %d bytes", granted[chat])
+	}
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := newScheduler(ctx)
+	s.setRate(10 << 20)
+
+	heavy, light := peer.ID("heavy"), peer.ID("light")
+	s.setWeight(heavy, 3)
+
+	var heavyBytes, lightBytes int64
+	var wg sync.WaitGroup
+	for _, c := range []struct {
+		p     peer.ID
+		count *int64
+	}{{heavy, &heavyBytes}, {light, &lightBytes}, {light, &lightBytes}} {
+		wg.Add(1)
+		go func(p peer.ID, count *int64) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				atomic.AddInt64(count, int64(s.acquire(p, 1<<20)))
+			}
+		}(c.p, c.count)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	h, l := atomic.LoadInt64(&heavyBytes), atomic.LoadInt64(&lightBytes)
+	cancel()
+	wg.Wait()
+
+	// the light peer has two circuits, but they share its weight
+	ratio := float64(h) / float64(l)
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Fatalf("expected a 3:1 share, got %d:%d", h, l)
+	}
+
+	// the total shouldn't exceed the rate (with some slack for timing)
+	if total := h + l; total > 6<<20 {
+		t.Fatalf("scheduled %d bytes in 500ms at 10MiB/s", total)
+	}
+}
@@ -0,0 +1,373 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-datastore"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+var (
+	// BanThreshold is the penalty score above which a hop relay bans a peer
+	// and refuses its relay streams.
+	BanThreshold = 100.0
+	// IPBanThreshold is the penalty score, summed over all the peers on an IP
+	// address, above which a hop relay bans the address. Peers behind the
+	// same NAT share an address, so banning addresses is disabled by default;
+	// set it to a positive score, well above BanThreshold, to enable it.
+	IPBanThreshold = 0.0
+	// BanDuration is how long a ban lasts.
+	BanDuration = 10 * time.Minute
+	// ScoreHalfLife is the period over which penalty scores decay by half.
+	ScoreHalfLife = 10 * time.Minute
+)
+
+// penalties are the scores accumulated by peers whose hop requests fail with
+// the given status, for failures that are the requesting peer's fault.
+// HOP_DST_MULTIADDR_INVALID isn't one of them, as active relays also return it
+// when their own address filter drops every destination address.
+var penalties = map[pb.CircuitRelay_Status]float64{
+	pb.CircuitRelay_MALFORMED_MESSAGE:         20,
+	pb.CircuitRelay_HOP_SRC_ADDR_TOO_LONG:     20,
+	pb.CircuitRelay_HOP_DST_ADDR_TOO_LONG:     20,
+	pb.CircuitRelay_HOP_SRC_MULTIADDR_INVALID: 20,
+	pb.CircuitRelay_HOP_CANT_RELAY_TO_SELF:    10,
+}
+
+// Penalties of peers whose hop requests make an active relay fail to dial the
+// destination, and of those asking for a destination that is backed off after
+// failed dials. A failed dial may not be the requesting peer's fault, but
+// asking again for destinations known to be unreachable is what peers
+// spamming hop requests do.
+const (
+	dialFailurePenalty = 2
+	dialBackoffPenalty = 5
+)
+
+// Ban is a temporary ban of a peer or an IP address from a hop relay; exactly
+// one of Peer and IP is set.
+type Ban struct {
+	Peer    peer.ID
+	IP      net.IP
+	Expires time.Time
+}
+
+type score struct {
+	value   float64
+	updated time.Time
+}
+
+func (s *score) decay(now time.Time) float64 {
+	s.value *= math.Pow(0.5, float64(now.Sub(s.updated))/float64(ScoreHalfLife))
+	s.updated = now
+	return s.value
+}
+
+// scoreboard tracks penalty scores and bans per peer and per IP address.
+type scoreboard struct {
+	mx       sync.Mutex
+	peers    map[peer.ID]*score
+	ips      map[string]*score
+	peerBans map[peer.ID]time.Time
+	ipBans   map[string]time.Time
+
+	// persisted bans
+	store *store
+}
+
+func newScoreboard() *scoreboard {
+	return &scoreboard{
+		peers:    make(map[peer.ID]*score),
+		ips:      make(map[string]*score),
+		peerBans: make(map[peer.ID]time.Time),
+		ipBans:   make(map[string]time.Time),
+	}
+}
+
+func connIP(c network.Conn) net.IP {
+	ip, err := manet.ToIP(c.RemoteMultiaddr())
+	if err != nil {
+		return nil
+	}
+	return ip
+}
+
+// penalize adds a penalty to the peer, banning it when its decayed score
+// exceeds BanThreshold, and to its IP address (if any) if IPBanThreshold is
+// set, banning the address when its decayed score exceeds IPBanThreshold.
+func (sb *scoreboard) penalize(p peer.ID, ip net.IP, penalty float64) {
+	var b batch
+	defer b.commit()
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	now := time.Now()
+
+	ps, ok := sb.peers[p]
+	if !ok {
+		ps = &score{updated: now}
+		sb.peers[p] = ps
+	}
+	if ps.decay(now)+penalty > BanThreshold {
+		log.Warnf("banning peer %s for %s", p, BanDuration)
+		sb.peerBans[p] = now.Add(BanDuration)
+		b.put(sb.store, peerKey(dsPeerBans, p), banRecord{Expires: sb.peerBans[p]})
+		delete(sb.peers, p)
+	} else {
+		ps.value += penalty
+	}
+
+	if ip == nil || IPBanThreshold <= 0 {
+		return
+	}
+
+	key := ip.String()
+	is, ok := sb.ips[key]
+	if !ok {
+		is = &score{updated: now}
+		sb.ips[key] = is
+	}
+	if is.decay(now)+penalty > IPBanThreshold {
+		log.Warnf("banning IP %s for %s", key, BanDuration)
+		sb.ipBans[key] = now.Add(BanDuration)
+		b.put(sb.store, ipKey(ip), banRecord{Expires: sb.ipBans[key]})
+		delete(sb.ips, key)
+	} else {
+		is.value += penalty
+	}
+}
+
+func (sb *scoreboard) banned(p peer.ID, ip net.IP) bool {
+	var b batch
+	defer b.commit()
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	now := time.Now()
+
+	if until, ok := sb.peerBans[p]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(sb.peerBans, p)
+		b.delete(sb.store, peerKey(dsPeerBans, p))
+	}
+
+	if ip == nil {
+		return false
+	}
+
+	key := ip.String()
+	if until, ok := sb.ipBans[key]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(sb.ipBans, key)
+		b.delete(sb.store, ipKey(ip))
+	}
+
+	return false
+}
+
+func (sb *scoreboard) score(p peer.ID) float64 {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	ps, ok := sb.peers[p]
+	if !ok {
+		return 0
+	}
+	return ps.decay(time.Now())
+}
+
+func (sb *scoreboard) bans() []Ban {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	now := time.Now()
+	result := make([]Ban, 0, len(sb.peerBans)+len(sb.ipBans))
+	for p, until := range sb.peerBans {
+		if now.Before(until) {
+			result = append(result, Ban{Peer: p, Expires: until})
+		}
+	}
+	for key, until := range sb.ipBans {
+		if now.Before(until) {
+			result = append(result, Ban{IP: net.ParseIP(key), Expires: until})
+		}
+	}
+	return result
+}
+
+func (sb *scoreboard) unban(p peer.ID) {
+	var b batch
+	defer b.commit()
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	delete(sb.peerBans, p)
+	delete(sb.peers, p)
+	b.delete(sb.store, peerKey(dsPeerBans, p))
+}
+
+func (sb *scoreboard) unbanIP(ip net.IP) {
+	var b batch
+	defer b.commit()
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	key := ip.String()
+	delete(sb.ipBans, key)
+	delete(sb.ips, key)
+	b.delete(sb.store, ipKey(ip))
+}
+
+func (sb *scoreboard) clear() {
+	var b batch
+	defer b.commit()
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	sb.peers = make(map[peer.ID]*score)
+	sb.ips = make(map[string]*score)
+	sb.peerBans = make(map[peer.ID]time.Time)
+	sb.ipBans = make(map[string]time.Time)
+	b.deleteAll(sb.store, dsBans)
+}
+
+// restore restores the unexpired bans persisted in s, and persists bans there
+// from now on.
+func (sb *scoreboard) restore(s *store) error {
+	now := time.Now()
+	peerBans := make(map[peer.ID]time.Time)
+	ipBans := make(map[string]time.Time)
+	var expired []datastore.Key
+
+	err := s.loadPeers(dsPeerBans, func(p peer.ID, v []byte) error {
+		var rec banRecord
+		if err := json.Unmarshal(v, &rec); err != nil || !now.Before(rec.Expires) {
+			expired = append(expired, peerKey(dsPeerBans, p))
+			return nil
+		}
+		peerBans[p] = rec.Expires
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = s.load(dsIPBans, func(k datastore.Key, v []byte) error {
+		var rec banRecord
+		ip := net.ParseIP(k.Name())
+		if err := json.Unmarshal(v, &rec); err != nil || ip == nil || !now.Before(rec.Expires) {
+			expired = append(expired, k)
+			return nil
+		}
+		ipBans[ip.String()] = rec.Expires
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		s.delete(k)
+	}
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	sb.store = s
+	for p, until := range peerBans {
+		sb.peerBans[p] = until
+	}
+	for key, until := range ipBans {
+		sb.ipBans[key] = until
+	}
+	return nil
+}
+
+// gc drops expired bans and scores that have decayed to nothing.
+func (sb *scoreboard) gc() {
+	var b batch
+	defer b.commit()
+
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+
+	now := time.Now()
+	for p, until := range sb.peerBans {
+		if !now.Before(until) {
+			delete(sb.peerBans, p)
+			b.delete(sb.store, peerKey(dsPeerBans, p))
+		}
+	}
+	for key, until := range sb.ipBans {
+		if !now.Before(until) {
+			delete(sb.ipBans, key)
+			b.delete(sb.store, ipKey(net.ParseIP(key)))
+		}
+	}
+	for p, s := range sb.peers {
+		if s.decay(now) < 1 {
+			delete(sb.peers, p)
+		}
+	}
+	for key, s := range sb.ips {
+		if s.decay(now) < 1 {
+			delete(sb.ips, key)
+		}
+	}
+}
+
+func (sb *scoreboard) background(ctx context.Context) {
+	ticker := time.NewTicker(ScoreHalfLife)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sb.gc()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Bans returns the active bans of a hop relay.
+func (r *Relay) Bans() []Ban {
+	return r.scores.bans()
+}
+
+// PeerScore returns the current (decayed) penalty score of a peer.
+func (r *Relay) PeerScore(p peer.ID) float64 {
+	return r.scores.score(p)
+}
+
+// Unban lifts the ban on a peer and resets its score.
+func (r *Relay) Unban(p peer.ID) {
+	r.scores.unban(p)
+}
+
+// UnbanIP lifts the ban on an IP address and resets its score.
+func (r *Relay) UnbanIP(ip net.IP) {
+	r.scores.unbanIP(ip)
+}
+
+// ClearBans lifts all bans and resets all scores.
+func (r *Relay) ClearBans() {
+	r.scores.clear()
+}
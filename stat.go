@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ConnStat is the stat of a relayed connection.
+type ConnStat struct {
+	Direction network.Direction
+	Opened    time.Time
+	// Relay is the relay the connection goes through; for chained circuits,
+	// the first relay.
+	Relay peer.ID
+	// RelayLocalAddr and RelayRemoteAddr are the addresses of the connection
+	// to the relay.
+	RelayLocalAddr, RelayRemoteAddr ma.Multiaddr
+	BytesRead, BytesWritten         uint64
+}
+
+// statKey is the key of the ConnStat getter in the Extra map of the stats of
+// relayed connections.
+type statKey struct{}
+
+// Stat returns the stat of the connection. The stat of the connections of the
+// relay transport, as upgraded by the transport upgrader, is derived from
+// it; use GetConnStat to get the ConnStat of any of them.
+func (c *Conn) Stat() network.ConnStats {
+	var stat network.ConnStats
+	stat.Direction = c.dir
+	stat.Opened = c.opened
+	stat.Extra = map[interface{}]interface{}{
+		statKey{}: c.RelayStat,
+	}
+	return stat
+}
+
+// RelayStat returns the ConnStat of the connection.
+func (c *Conn) RelayStat() ConnStat {
+	rc := c.stream.Conn()
+	return ConnStat{
+		Direction:       c.dir,
+		Opened:          c.opened,
+		Relay:           rc.RemotePeer(),
+		RelayLocalAddr:  rc.LocalMultiaddr(),
+		RelayRemoteAddr: rc.RemoteMultiaddr(),
+		BytesRead:       atomic.LoadUint64(&c.bytesRead),
+		BytesWritten:    atomic.LoadUint64(&c.bytesWritten),
+	}
+}
+
+var _ network.ConnStat = (*ResumableConn)(nil)
+
+// Stat returns the stat of the current circuit of the connection, which
+// changes when it is resumed through another relay.
+func (rc *ResumableConn) Stat() network.ConnStats {
+	stat := rc.current().Stat()
+	stat.Extra[statKey{}] = rc.RelayStat
+	return stat
+}
+
+// RelayStat returns the ConnStat of the current circuit of the connection.
+func (rc *ResumableConn) RelayStat() ConnStat {
+	return rc.current().RelayStat()
+}
+
+// GetConnStat returns the current ConnStat of c, if it is a relayed
+// connection: a Conn or a ResumableConn, or a network or transport connection
+// on top of one.
+func GetConnStat(c network.ConnStat) (ConnStat, bool) {
+	get, ok := c.Stat().Extra[statKey{}].(func() ConnStat)
+	if !ok {
+		return ConnStat{}, false
+	}
+	return get(), true
+}
@@ -0,0 +1,302 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Connection manager tags. Hop relays tag the peers at the ends of the
+// circuits they relay with hopTag, and peers tag the relays of their relayed
+// connections with relayTag; a peer can be both, so the tags are distinct.
+const (
+	hopTag         = "relay-hop-stream"
+	relayTag       = "relay-conn"
+	reservationTag = "relay-reservation"
+)
+
+// TagUpdateInterval is the interval at which hop relays update the
+// connection manager weights of the peers at the ends of their circuits, to
+// account for the traffic relayed since circuits opened.
+var TagUpdateInterval = 10 * time.Second
+
+// TagInfo describes the circuits a hop relay relays for a peer.
+type TagInfo struct {
+	// Circuits is the number of open circuits the peer is at one end of.
+	Circuits int
+	// BytesRelayed is the number of bytes relayed to and from the peer since
+	// it last had no open circuits.
+	BytesRelayed uint64
+	// Reserved reports whether the peer is a reserved client of the relay.
+	Reserved bool
+}
+
+// TagStrategy computes the connection manager weight of a peer at one end of
+// circuits relayed by a hop relay; a weight of 0 removes its tag.
+type TagStrategy func(p peer.ID, info TagInfo) int
+
+// DefaultTagStrategy weighs peers by their number of circuits.
+func DefaultTagStrategy(p peer.ID, info TagInfo) int {
+	return info.Circuits
+}
+
+// hopTraffic is the traffic a hop relay relays for a peer.
+type hopTraffic struct {
+	// accessed atomically
+	bytes uint64
+
+	circuits int
+}
+
+func (t *hopTraffic) add(n int) {
+	atomic.AddUint64(&t.bytes, uint64(n))
+}
+
+// tagger maintains the connection manager tags of the peers at the ends of
+// the circuits relayed by a hop relay, and of the relays of relayed
+// connections.
+type tagger struct {
+	host     host.Host
+	interval time.Duration
+
+	mx       sync.Mutex
+	strategy TagStrategy
+	peers    map[peer.ID]*hopTraffic
+	reserved map[peer.ID]struct{}
+	// number of relayed connections through each relay
+	relays map[peer.ID]int
+
+	store *store
+}
+
+func newTagger(h host.Host) *tagger {
+	return &tagger{
+		host:     h,
+		interval: TagUpdateInterval,
+		strategy: DefaultTagStrategy,
+		peers:    make(map[peer.ID]*hopTraffic),
+		reserved: make(map[peer.ID]struct{}),
+		relays:   make(map[peer.ID]int),
+	}
+}
+
+// acquire records a new relayed connection through relay p, tagging p with
+// HopTagWeight for as long as it has relayed connections.
+func (tg *tagger) acquire(p peer.ID) {
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	tg.relays[p]++
+	if tg.relays[p] == 1 {
+		tg.host.ConnManager().TagPeer(p, relayTag, HopTagWeight)
+	}
+}
+
+// release records the end of a relayed connection through relay p.
+func (tg *tagger) release(p peer.ID) {
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	n, ok := tg.relays[p]
+	if !ok {
+		return
+	}
+	if n > 1 {
+		tg.relays[p] = n - 1
+		return
+	}
+	delete(tg.relays, p)
+	tg.host.ConnManager().UntagPeer(p, relayTag)
+}
+
+// open records a new circuit of p, and returns the traffic the circuit's
+// bytes are accounted to.
+func (tg *tagger) open(p peer.ID) *hopTraffic {
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	t, ok := tg.peers[p]
+	if !ok {
+		t = new(hopTraffic)
+		tg.peers[p] = t
+	}
+	t.circuits++
+	tg.update(p)
+	return t
+}
+
+// close records the end of a circuit of p.
+func (tg *tagger) close(p peer.ID) {
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	t, ok := tg.peers[p]
+	if !ok {
+		return
+	}
+	t.circuits--
+	if t.circuits == 0 {
+		delete(tg.peers, p)
+	}
+	tg.update(p)
+}
+
+// update sets the tag of p from its current traffic; tg.mx must be held.
+func (tg *tagger) update(p peer.ID) {
+	info := TagInfo{}
+	if t, ok := tg.peers[p]; ok {
+		info.Circuits = t.circuits
+		info.BytesRelayed = atomic.LoadUint64(&t.bytes)
+	}
+	_, info.Reserved = tg.reserved[p]
+
+	if w := tg.strategy(p, info); w != 0 {
+		tg.host.ConnManager().TagPeer(p, hopTag, w)
+	} else {
+		tg.host.ConnManager().UntagPeer(p, hopTag)
+	}
+}
+
+func (tg *tagger) setStrategy(s TagStrategy) {
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	tg.strategy = s
+	tg.updateAll()
+}
+
+func (tg *tagger) setReserved(p peer.ID, reserved bool) {
+	var b batch
+	defer b.commit()
+
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	if reserved {
+		tg.reserved[p] = struct{}{}
+		b.put(tg.store, peerKey(dsReserved, p), struct{}{})
+	} else {
+		delete(tg.reserved, p)
+		b.delete(tg.store, peerKey(dsReserved, p))
+	}
+	tg.update(p)
+}
+
+// restore restores the reserved clients persisted in s, and persists them
+// there from now on.
+func (tg *tagger) restore(s *store) error {
+	var reserved []peer.ID
+	err := s.loadPeers(dsReserved, func(p peer.ID, _ []byte) error {
+		reserved = append(reserved, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tg.mx.Lock()
+	defer tg.mx.Unlock()
+
+	tg.store = s
+	for _, p := range reserved {
+		tg.reserved[p] = struct{}{}
+		tg.update(p)
+	}
+	return nil
+}
+
+// updateAll updates the tags of all the peers; tg.mx must be held.
+func (tg *tagger) updateAll() {
+	for p := range tg.peers {
+		tg.update(p)
+	}
+	for p := range tg.reserved {
+		if _, ok := tg.peers[p]; !ok {
+			tg.update(p)
+		}
+	}
+}
+
+func (tg *tagger) background(ctx context.Context) {
+	ticker := time.NewTicker(tg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tg.mx.Lock()
+			tg.updateAll()
+			tg.mx.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// trafficReader accounts the bytes read to the traffic of the peers at both
+// ends of a circuit.
+type trafficReader struct {
+	r       io.Reader
+	traffic []*hopTraffic
+}
+
+func (t *trafficReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		for _, tr := range t.traffic {
+			tr.add(n)
+		}
+	}
+	return n, err
+}
+
+// SetTagStrategy sets the strategy computing the connection manager weights
+// of the peers at the ends of the circuits relayed by a hop relay. A nil
+// strategy restores DefaultTagStrategy.
+func (r *Relay) SetTagStrategy(s TagStrategy) {
+	if s == nil {
+		s = DefaultTagStrategy
+	}
+	r.tags.setStrategy(s)
+}
+
+// ReserveClient marks p as a reserved client of the relay, which is reported
+// to the tag strategy. Circuit relay v1 has no reservation protocol: the
+// application granting reservations records them here.
+func (r *Relay) ReserveClient(p peer.ID) {
+	r.tags.setReserved(p, true)
+}
+
+// UnreserveClient removes the reservation of client p.
+func (r *Relay) UnreserveClient(p peer.ID) {
+	r.tags.setReserved(p, false)
+}
+
+// ProtectRelay protects the connections to relay p, which the local peer
+// holds a reservation on, from being pruned by the connection manager.
+func (r *Relay) ProtectRelay(p peer.ID) {
+	var b batch
+	r.mx.Lock()
+	b.put(r.store, peerKey(dsProtected, p), struct{}{})
+	r.mx.Unlock()
+	b.commit()
+
+	r.host.ConnManager().Protect(p, reservationTag)
+}
+
+// UnprotectRelay removes the protection of ProtectRelay from relay p. It
+// returns whether the connections to p are still protected by other tags.
+func (r *Relay) UnprotectRelay(p peer.ID) bool {
+	var b batch
+	r.mx.Lock()
+	b.delete(r.store, peerKey(dsProtected, p))
+	r.mx.Unlock()
+	b.commit()
+
+	return r.host.ConnManager().Unprotect(p, reservationTag)
+}
@@ -0,0 +1,187 @@
+package relay_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/libp2p/go-libp2p-circuit"
+	"github.com/libp2p/go-libp2p-circuit/relaytest"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	hopTag   = "relay-hop-stream"
+	relayTag = "relay-conn"
+)
+
+// waitTag waits for the weight of the hop tag of p on node to satisfy ok.
+func waitTag(t *testing.T, node *relaytest.Node, p peer.ID, ok func(w int, tagged bool) bool) {
+	t.Helper()
+	waitTagged(t, node, p, hopTag, ok)
+}
+
+// waitTagged waits for the weight of tag on p on node to satisfy ok.
+func waitTagged(t *testing.T, node *relaytest.Node, p peer.ID, tag string, ok func(w int, tagged bool) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w, tagged := node.ConnMgr.Tag(p, tag)
+		if ok(w, tagged) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected %s tag of %s: %d (tagged: %t)", tag, p, w, tagged)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHopTags(t *testing.T) {
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	src, r, dst := nw.Nodes[0], nw.Nodes[1], nw.Nodes[2]
+
+	accept := dst.Accept()
+	c, err := nw.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := accept()
+
+	for _, node := range []*relaytest.Node{src, dst} {
+		waitTag(t, r, node.Host.ID(), func(w int, _ bool) bool { return w == 1 })
+	}
+
+	c.Close()
+	dc.Close()
+
+	for _, node := range []*relaytest.Node{src, dst} {
+		waitTag(t, r, node.Host.ID(), func(_ int, tagged bool) bool { return !tagged })
+	}
+}
+
+func TestHopTagStrategy(t *testing.T) {
+	defer func(d time.Duration) { TagUpdateInterval = d }(TagUpdateInterval)
+	TagUpdateInterval = 20 * time.Millisecond
+
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	src, r := nw.Nodes[0], nw.Nodes[1]
+
+	r.Relay.SetTagStrategy(func(p peer.ID, info TagInfo) int {
+		w := 10*info.Circuits + int(info.BytesRelayed>>10)
+		if info.Reserved {
+			w += 1000
+		}
+		return w
+	})
+
+	// reserved clients are tagged without circuits
+	r.Relay.ReserveClient(src.Host.ID())
+	waitTag(t, r, src.Host.ID(), func(w int, _ bool) bool { return w == 1000 })
+
+	accept := nw.Nodes[2].Accept()
+	c, err := nw.DialRelayed(context.Background(), 0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dc := accept()
+	defer dc.Close()
+
+	// the weight grows with the traffic of open circuits
+	go io.Copy(io.Discard, dc)
+	if _, err := c.Write(make([]byte, 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	waitTag(t, r, src.Host.ID(), func(w int, _ bool) bool { return w >= 1000+10+64 })
+
+	r.Relay.UnreserveClient(src.Host.ID())
+	waitTag(t, r, src.Host.ID(), func(w int, _ bool) bool { return w >= 10+64 && w < 1000 })
+
+	// and the default strategy is restored
+	r.Relay.SetTagStrategy(nil)
+	waitTag(t, r, src.Host.ID(), func(w int, _ bool) bool { return w == 1 })
+}
+
+func TestProtectRelay(t *testing.T) {
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Client))
+	src, r := nw.Nodes[0], nw.Nodes[1]
+
+	src.Relay.ProtectRelay(r.Host.ID())
+	if !src.ConnMgr.IsProtected(r.Host.ID(), "") {
+		t.Fatal("expected the relay to be protected")
+	}
+
+	if src.Relay.UnprotectRelay(r.Host.ID()) {
+		t.Fatal("expected the relay to have no other protection")
+	}
+	if src.ConnMgr.IsProtected(r.Host.ID(), "") {
+		t.Fatal("expected the relay to be unprotected")
+	}
+}
+
+func TestTagsBothRoles(t *testing.T) {
+	// node 1 relays circuits from node 0 to node 2, and dials node 3 through
+	// node 2: node 2 is both a hop peer and a relay of node 1
+	nw := relaytest.New(t, relaytest.Line(relaytest.Client, relaytest.Hop, relaytest.Hop, relaytest.Client))
+	node1, id0, id1, id2 := nw.Nodes[1], nw.Nodes[0].Host.ID(), nw.Nodes[1].Host.ID(), nw.Nodes[2].Host.ID()
+
+	accepted2 := nw.Nodes[2].AcceptAll()
+	accepted3 := nw.Nodes[3].AcceptAll()
+
+	const n = 10
+
+	var (
+		wg    sync.WaitGroup
+		mx    sync.Mutex
+		conns []net.Conn
+	)
+	dial := func(src, r, dst int, accepted <-chan net.Conn) {
+		defer wg.Done()
+		c, err := nw.DialRelayed(context.Background(), src, r, dst)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mx.Lock()
+		conns = append(conns, c, <-accepted)
+		mx.Unlock()
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go dial(0, 1, 2, accepted2)
+		go dial(1, 2, 3, accepted3)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	exactly := func(w int) func(int, bool) bool {
+		return func(v int, tagged bool) bool { return tagged && v == w }
+	}
+	waitTagged(t, node1, id0, hopTag, exactly(n))
+	waitTagged(t, node1, id2, hopTag, exactly(n))
+	waitTagged(t, node1, id2, relayTag, exactly(HopTagWeight))
+	waitTagged(t, nw.Nodes[0], id1, relayTag, exactly(HopTagWeight))
+
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+
+	untagged := func(_ int, tagged bool) bool { return !tagged }
+	waitTagged(t, node1, id0, hopTag, untagged)
+	waitTagged(t, node1, id2, hopTag, untagged)
+	waitTagged(t, node1, id2, relayTag, untagged)
+	waitTagged(t, nw.Nodes[0], id1, relayTag, untagged)
+}
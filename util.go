@@ -1,11 +1,13 @@
 package relay
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
 
 	pb "github.com/libp2p/go-libp2p-circuit/pb"
 
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	pool "github.com/libp2p/go-buffer-pool"
@@ -13,14 +15,39 @@ import (
 
 	"github.com/gogo/protobuf/proto"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/multiformats/go-varint"
 )
 
+var errAddrTooLong = errors.New("peer addresses exceed limits")
+
+// malformedError is an error decoding a relay message, as opposed to an error
+// reading it from the stream.
+type malformedError struct {
+	err error
+}
+
+func (e malformedError) Error() string { return e.err.Error() }
+func (e malformedError) Unwrap() error { return e.err }
+
+// isMalformed reports whether err is a failure to decode a relay message.
+func isMalformed(err error) bool {
+	var me malformedError
+	return errors.As(err, &me)
+}
+
+// peerToPeerInfo converts a peer from a relay message, dropping invalid
+// addresses. It returns errAddrTooLong if the peer advertises more than
+// MaxPeerAddrs addresses or an address longer than MaxAddrLength bytes.
 func peerToPeerInfo(p *pb.CircuitRelay_Peer) (peer.AddrInfo, error) {
 	if p == nil {
 		return peer.AddrInfo{}, errors.New("nil peer")
 	}
 
+	if len(p.Addrs) > MaxPeerAddrs {
+		return peer.AddrInfo{}, errAddrTooLong
+	}
+
 	id, err := peer.IDFromBytes(p.Id)
 	if err != nil {
 		return peer.AddrInfo{}, err
@@ -28,6 +55,10 @@ func peerToPeerInfo(p *pb.CircuitRelay_Peer) (peer.AddrInfo, error) {
 
 	addrs := make([]ma.Multiaddr, 0, len(p.Addrs))
 	for _, addrBytes := range p.Addrs {
+		if len(addrBytes) > MaxAddrLength {
+			return peer.AddrInfo{}, errAddrTooLong
+		}
+
 		a, err := ma.NewMultiaddrBytes(addrBytes)
 		if err == nil {
 			addrs = append(addrs, a)
@@ -37,10 +68,25 @@ func peerToPeerInfo(p *pb.CircuitRelay_Peer) (peer.AddrInfo, error) {
 	return peer.AddrInfo{ID: id, Addrs: addrs}, nil
 }
 
+// peerInfoToPeer converts a peer for a relay message, within the limits that
+// relays enforce: addresses longer than MaxAddrLength bytes are dropped, and
+// only the first MaxPeerAddrs addresses are kept, public ones first.
 func peerInfoToPeer(pi peer.AddrInfo) *pb.CircuitRelay_Peer {
-	addrs := make([][]byte, len(pi.Addrs))
-	for i, addr := range pi.Addrs {
-		addrs[i] = addr.Bytes()
+	var public, private [][]byte
+	for _, addr := range pi.Addrs {
+		b := addr.Bytes()
+		if len(b) > MaxAddrLength {
+			continue
+		}
+		if manet.IsPublicAddr(addr) {
+			public = append(public, b)
+		} else {
+			private = append(private, b)
+		}
+	}
+	addrs := append(public, private...)
+	if len(addrs) > MaxPeerAddrs {
+		addrs = addrs[:MaxPeerAddrs]
 	}
 
 	p := new(pb.CircuitRelay_Peer)
@@ -50,35 +96,23 @@ func peerInfoToPeer(pi peer.AddrInfo) *pb.CircuitRelay_Peer {
 	return p
 }
 
-func incrementTag(v int) int {
-	return v + 1
-}
-
-func decrementTag(v int) int {
-	if v > 0 {
-		return v - 1
-	} else {
-		return v
-	}
-}
-
+// delimitedReader reads length-delimited messages from a stream. The gogo
+// protobuf NewDelimitedReader is buffered and would eat up any stream data
+// following the handshake, so this reader reads ahead into its own buffer
+// and hands the bytes it over-read back through stream, which must be used
+// in place of the underlying stream once the handshake is done.
+// Reading ahead means that a message usually takes a single Read, instead of
+// one Read per byte of the length prefix and another for the payload.
 type delimitedReader struct {
 	r   io.Reader
 	buf []byte
+	// buffered bytes are buf[start:end]
+	start, end int
+	err        error
 }
 
-// The gogo protobuf NewDelimitedReader is buffered, which may eat up stream data.
-// So we need to implement a compatible delimited reader that reads unbuffered.
-// There is a slowdown from unbuffered reading: when reading the message
-// it can take multiple single byte Reads to read the length and another Read
-// to read the message payload.
-// However, this is not critical performance degradation as
-// - the reader is utilized to read one (dialer, stop) or two messages (hop) during
-//   the handshake, so it's a drop in the water for the connection lifetime.
-// - messages are small (max 4k) and the length fits in a couple of bytes,
-//   so overall we have at most three reads per message.
 func newDelimitedReader(r io.Reader, maxSize int) *delimitedReader {
-	return &delimitedReader{r: r, buf: pool.Get(maxSize)}
+	return &delimitedReader{r: r, buf: pool.Get(maxSize + binary.MaxVarintLen64)}
 }
 
 func (d *delimitedReader) Close() {
@@ -88,29 +122,98 @@ func (d *delimitedReader) Close() {
 	}
 }
 
+// fill reads at least one more byte into the buffer, unless an error occurs.
+func (d *delimitedReader) fill() error {
+	if d.start > 0 {
+		d.end = copy(d.buf, d.buf[d.start:d.end])
+		d.start = 0
+	}
+
+	for d.err == nil {
+		n, err := d.r.Read(d.buf[d.end:])
+		d.end += n
+		d.err = err
+		if n > 0 {
+			return nil
+		}
+	}
+	return d.err
+}
+
 func (d *delimitedReader) ReadByte() (byte, error) {
-	buf := d.buf[:1]
-	_, err := d.r.Read(buf)
-	return buf[0], err
+	if d.start == d.end {
+		if err := d.fill(); err != nil {
+			return 0, err
+		}
+	}
+	b := d.buf[d.start]
+	d.start++
+	return b, nil
 }
 
 func (d *delimitedReader) ReadMsg(msg proto.Message) error {
 	mlen, err := varint.ReadUvarint(d)
-	if err != nil {
+	switch err {
+	case nil:
+	case varint.ErrOverflow, varint.ErrNotMinimal:
+		return malformedError{err}
+	default:
 		return err
 	}
 
-	if uint64(len(d.buf)) < mlen {
-		return errors.New("message too large")
+	if uint64(len(d.buf)-binary.MaxVarintLen64) < mlen {
+		return malformedError{errors.New("message too large")}
 	}
 
-	buf := d.buf[:mlen]
-	_, err = io.ReadFull(d.r, buf)
-	if err != nil {
-		return err
+	for uint64(d.end-d.start) < mlen {
+		if err := d.fill(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	buf := d.buf[d.start : d.start+int(mlen)]
+	d.start += int(mlen)
+
+	if err := proto.Unmarshal(buf, msg); err != nil {
+		return malformedError{err}
+	}
+	return nil
+}
+
+// Buffered returns the bytes read ahead of the last message.
+func (d *delimitedReader) Buffered() []byte {
+	return d.buf[d.start:d.end]
+}
+
+// stream returns s with the bytes read ahead of the last message put back
+// in front of it. It must be called before Close.
+func (d *delimitedReader) stream(s network.Stream) network.Stream {
+	if d.start == d.end {
+		return s
+	}
+
+	buf := make([]byte, d.end-d.start)
+	copy(buf, d.buf[d.start:d.end])
+	return &prefixStream{Stream: s, prefix: buf}
+}
+
+// prefixStream is a stream whose reads return prefix before the stream data.
+type prefixStream struct {
+	network.Stream
+	prefix []byte
+}
+
+func (s *prefixStream) Read(p []byte) (int, error) {
+	if len(s.prefix) == 0 {
+		return s.Stream.Read(p)
 	}
 
-	return proto.Unmarshal(buf, msg)
+	n := copy(p, s.prefix)
+	s.prefix = s.prefix[n:]
+	return n, nil
 }
 
 func newDelimitedWriter(w io.Writer) protoio.WriteCloser {
@@ -0,0 +1,149 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	pb "github.com/libp2p/go-libp2p-circuit/pb"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+// readerStream is a stream reading from r.
+type readerStream struct {
+	network.Stream
+	r io.Reader
+}
+
+func (s *readerStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// countingReader counts the Read calls on r.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestDelimitedReaderPreservesTrailingData(t *testing.T) {
+	var buf bytes.Buffer
+	wr := protoio.NewDelimitedWriter(&buf)
+	for _, code := range []pb.CircuitRelay_Status{pb.CircuitRelay_SUCCESS, pb.CircuitRelay_HOP_CANT_DIAL_DST} {
+		msg := &pb.CircuitRelay{Type: pb.CircuitRelay_STATUS.Enum(), Code: code.Enum()}
+		if err := wr.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payload := bytes.Repeat([]byte("relayed data"), 1000)
+	buf.Write(payload)
+
+	cr := &countingReader{r: bytes.NewReader(buf.Bytes())}
+	rd := newDelimitedReader(cr, maxMessageSize)
+
+	var msg pb.CircuitRelay
+	if err := rd.ReadMsg(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetCode() != pb.CircuitRelay_SUCCESS {
+		t.Fatalf("expected SUCCESS, got %d", msg.GetCode())
+	}
+	if err := rd.ReadMsg(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetCode() != pb.CircuitRelay_HOP_CANT_DIAL_DST {
+		t.Fatalf("expected HOP_CANT_DIAL_DST, got %d", msg.GetCode())
+	}
+	if cr.reads != 1 {
+		t.Fatalf("expected both messages to be read at once, got %d reads", cr.reads)
+	}
+
+	s := rd.stream(&readerStream{r: cr})
+	rd.Close()
+
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("lost data after the handshake: got %d bytes, expected %d", len(data), len(payload))
+	}
+}
+
+func TestDelimitedReaderShortReads(t *testing.T) {
+	var buf bytes.Buffer
+	msg := &pb.CircuitRelay{Type: pb.CircuitRelay_STATUS.Enum(), Code: pb.CircuitRelay_SUCCESS.Enum()}
+	if err := protoio.NewDelimitedWriter(&buf).WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing")
+
+	r := &readerStream{r: iotest.OneByteReader(bytes.NewReader(buf.Bytes()))}
+	rd := newDelimitedReader(r, maxMessageSize)
+	defer rd.Close()
+
+	if err := rd.ReadMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing was read ahead, so the stream is used as is
+	if s := rd.stream(r); s != network.Stream(r) {
+		t.Fatal("expected the stream to be returned unwrapped")
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "trailing" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestDelimitedReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	msg := &pb.CircuitRelay{Type: pb.CircuitRelay_STATUS.Enum(), Code: pb.CircuitRelay_SUCCESS.Enum()}
+	if err := protoio.NewDelimitedWriter(&buf).WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	rd := newDelimitedReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), maxMessageSize)
+	defer rd.Close()
+
+	if err := rd.ReadMsg(msg); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDelimitedReaderMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		malformed bool
+	}{
+		{"bad varint", []byte{0x80, 0x00}, true},
+		{"too large", []byte{0xff, 0xff, 0x03}, true},
+		{"bad message", []byte{0x02, 0xff, 0xff}, true},
+		{"empty", nil, false},
+		{"truncated", []byte{0x05, 0x08}, false},
+	} {
+		rd := newDelimitedReader(bytes.NewReader(tc.data), maxMessageSize)
+		err := rd.ReadMsg(new(pb.CircuitRelay))
+		rd.Close()
+		if err == nil {
+			t.Fatalf("%s: expected an error", tc.name)
+		}
+		if isMalformed(err) != tc.malformed {
+			t.Fatalf("%s: expected malformed to be %t, got %v", tc.name, tc.malformed, err)
+		}
+	}
+}